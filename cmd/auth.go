@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/container"
+	"github.com/samirkut/rcon/utils"
+)
+
+var authKeyFile string
+
+// authCmd represents the auth command
+var authCmd = &cobra.Command{
+	Use:   "auth",
+	Short: "Manage encryption of the auth file",
+	Long: `Secrets in the auth file can be encrypted at rest. The key is derived from the file given with --auth-key-file, 
+	or the passphrase in ` + container.AuthPassphraseEnv + `, which every command reading the auth file then needs`,
+}
+
+// authEncryptCmd represents the auth encrypt command
+var authEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt a plaintext auth file",
+	Long: `Converts the auth file to the encrypted format. Logins saved later are encrypted too. 
+	A new random key is written to --auth-key-file if it does not exist`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		authFile, err = utils.ExpandPath(authFile)
+		if err != nil {
+			return err
+		}
+
+		if authKeyFile != "" && !utils.PathExists(authKeyFile) {
+			err = container.GenerateAuthKeyFile(authKeyFile)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Generated key file %s\n", authKeyFile)
+		}
+
+		helper := &container.AuthHelper{AuthFile: authFile}
+		return helper.Encrypt()
+	},
+}
+
+// authDecryptCmd represents the auth decrypt command
+var authDecryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Convert an encrypted auth file back to plaintext",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		authFile, err = utils.ExpandPath(authFile)
+		if err != nil {
+			return err
+		}
+
+		helper := &container.AuthHelper{AuthFile: authFile}
+		return helper.Decrypt()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(authCmd)
+	authCmd.AddCommand(authEncryptCmd)
+	authCmd.AddCommand(authDecryptCmd)
+
+	authEncryptCmd.Flags().StringVar(&authFile, "auth-file", "~/.rcon/auth.json", "auth file (json) for accessing container registry")
+	authDecryptCmd.Flags().StringVar(&authFile, "auth-file", "~/.rcon/auth.json", "auth file (json) for accessing container registry")
+}
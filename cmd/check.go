@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/container"
+	"github.com/samirkut/rcon/utils"
+)
+
+var checkDryRun bool
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the cache for inconsistencies",
+	Long: `Checks the cache for refs pointing to missing or incomplete images and for records of containers no longer running. 
+	These are repaired by removing the broken refs, which are fetched again on next use, and the stale records`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		cacheDir, err = utils.EnsureDir(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		if cacheDir == "" {
+			return errors.New("--cache-dir is required")
+		}
+
+		issues, err := container.CheckCache(cacheDir, !checkDryRun)
+		for _, issue := range issues {
+			if issue.Repaired {
+				fmt.Printf("Repaired: %s\n", issue.Problem)
+			} else {
+				fmt.Printf("Found: %s\n", issue.Problem)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(issues) == 0 {
+			fmt.Println("No problems found")
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+
+	checkCmd.Flags().StringVar(&cacheDir, "cache-dir", "~/.rcon/cache", "cache folder for images")
+	checkCmd.Flags().BoolVar(&checkDryRun, "dry-run", false, "only report problems without repairing them")
+}
@@ -33,7 +33,10 @@ var fetchCmd = &cobra.Command{
 			return err
 		}
 
-		imageRef := args[0]
+		imageRef, err := resolveImageRef(args[0])
+		if err != nil {
+			return err
+		}
 
 		return container.FetchContainer(imageRef, cacheDir, authFile, true)
 	},
@@ -44,4 +47,7 @@ func init() {
 
 	fetchCmd.Flags().StringVar(&cacheDir, "cache-dir", "~/.rcon/cache", "cache folder for images")
 	fetchCmd.Flags().StringVar(&authFile, "auth-file", "~/.rcon/auth.json", "auth file (json) for accessing container registry")
+	fetchCmd.Flags().StringVar(&lockFile, "lock-file", "rcon.lock", "lock file pinning image refs to digests, used if it exists")
+	fetchCmd.Flags().StringVar(&platform, "platform", "", "platform to fetch from a multi-arch image as os/arch[/variant], defaults to linux/amd64")
+	addFetchFlags(fetchCmd)
 }
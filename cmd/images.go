@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/container"
+	"github.com/samirkut/rcon/utils"
+)
+
+var (
+	imagesFormat string
+	imagesQuiet  bool
+)
+
+// imagesCmd represents the images command
+var imagesCmd = &cobra.Command{
+	Use:   "images",
+	Short: "List the images stored in cache",
+	Long:  `Lists each cached image ref along with its config digest, size on disk and when it was fetched`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		cacheDir, err = utils.EnsureDir(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		if cacheDir == "" {
+			return errors.New("--cache-dir is required")
+		}
+
+		images, err := container.ListImages(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		if imagesQuiet {
+			seen := map[string]bool{}
+			for _, img := range images {
+				if !seen[img.Digest] {
+					seen[img.Digest] = true
+					fmt.Println(img.Digest)
+				}
+			}
+			return nil
+		}
+
+		switch imagesFormat {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(images)
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "REF\tDIGEST\tSIZE\tFETCHED")
+			for _, img := range images {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", img.Ref, shortDigest(img.Digest), utils.HumanSize(img.Size), img.Fetched.Format("2006-01-02 15:04:05"))
+			}
+			return w.Flush()
+		default:
+			return fmt.Errorf("unknown --format %s", imagesFormat)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(imagesCmd)
+
+	imagesCmd.Flags().StringVar(&cacheDir, "cache-dir", "~/.rcon/cache", "cache folder for images")
+	imagesCmd.Flags().StringVar(&imagesFormat, "format", "table", "output format: table or json")
+	// shadows the global --quiet, which only disables logging
+	imagesCmd.Flags().BoolVarP(&imagesQuiet, "quiet", "q", false, "only print image digests")
+}
+
+// strip the algorithm and abbreviate a digest for display
+func shortDigest(digest string) string {
+	if i := strings.Index(digest, ":"); i >= 0 {
+		digest = digest[i+1:]
+	}
+
+	if len(digest) > 12 {
+		digest = digest[:12]
+	}
+
+	return digest
+}
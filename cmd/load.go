@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/container"
+	"github.com/samirkut/rcon/utils"
+)
+
+// loadCmd represents the load command
+var loadCmd = &cobra.Command{
+	Use:   "load file|dir",
+	Short: "Load images from a docker save tarball or an OCI image layout",
+	Long: `Imports all images in a tarball created by docker save, or an OCI image layout directory, into the cache. 
+	Images are cached under the names they were saved with. They can also be run directly with refs like oci:/path/to/layout:tag or docker-archive:/path/to/file.tar`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		cacheDir, err = utils.EnsureDir(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		if cacheDir == "" {
+			return errors.New("--cache-dir is required")
+		}
+
+		path, err := utils.ExpandPath(args[0])
+		if err != nil {
+			return err
+		}
+
+		refs, err := container.LoadArchive(path, cacheDir)
+		for _, ref := range refs {
+			fmt.Printf("Loaded: %s\n", ref)
+		}
+
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(loadCmd)
+
+	loadCmd.Flags().StringVar(&cacheDir, "cache-dir", "~/.rcon/cache", "cache folder for images")
+	addProgressFlag(loadCmd)
+}
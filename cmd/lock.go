@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/container"
+	"github.com/samirkut/rcon/utils"
+)
+
+var lockFile string
+
+// lockCmd represents the lock command
+var lockCmd = &cobra.Command{
+	Use:   "lock",
+	Short: "Manage the lock file pinning image refs to digests",
+	Long: `Image refs listed in the lock file (rcon.lock in the current folder by default) are replaced by the digest they are pinned to when fetching or running. 
+	This guarantees identical images are used across machines`,
+}
+
+// lockUpdateCmd represents the lock update command
+var lockUpdateCmd = &cobra.Command{
+	Use:   "update [image-path...]",
+	Short: "Pin image refs to their current digests",
+	Long: `Resolves the provided image refs against their registries and records the digests in the lock file. 
+	All refs already in the lock file are refreshed if none are provided`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		authFile, err = utils.ExpandPath(authFile)
+		if err != nil {
+			return err
+		}
+
+		lockFile, err = utils.ExpandPath(lockFile)
+		if err != nil {
+			return err
+		}
+
+		if lockFile == "" {
+			return errors.New("--lock-file is required")
+		}
+
+		lock, err := container.LoadImageLock(lockFile)
+		if err != nil {
+			return err
+		}
+
+		refs := args
+		if len(refs) == 0 {
+			for imageRef := range lock.Images {
+				refs = append(refs, imageRef)
+			}
+			sort.Strings(refs)
+		}
+
+		for _, imageRef := range refs {
+			digest, err := lock.Update(imageRef, authFile)
+			if err != nil {
+				return fmt.Errorf("resolve %s: %w", imageRef, err)
+			}
+			fmt.Printf("%s: %s\n", imageRef, digest)
+		}
+
+		return lock.Save(lockFile)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lockCmd)
+	lockCmd.AddCommand(lockUpdateCmd)
+
+	lockUpdateCmd.Flags().StringVar(&lockFile, "lock-file", "rcon.lock", "lock file pinning image refs to digests")
+	lockUpdateCmd.Flags().StringVar(&authFile, "auth-file", "~/.rcon/auth.json", "auth file (json) for accessing container registry")
+	addRegistryFlags(lockUpdateCmd)
+}
+
+// resolve the image ref to fetch or run: refs in the lock file are replaced by
+// the digest they are pinned to, and qualified with the platform if provided
+func resolveImageRef(imageRef string) (string, error) {
+	imageRef, err := container.NormalizeRef(imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	if lockFile != "" {
+		path, err := utils.ExpandPath(lockFile)
+		if err != nil {
+			return "", err
+		}
+
+		lock, err := container.LoadImageLock(path)
+		if err != nil {
+			return "", err
+		}
+
+		pinned, err := lock.Resolve(imageRef)
+		if err != nil {
+			return "", err
+		}
+
+		if pinned != imageRef {
+			logger.Infof("Using %s pinned in %s", pinned, path)
+			imageRef = pinned
+		}
+	}
+
+	return container.PlatformRef(imageRef, platform)
+}
@@ -1,8 +1,13 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
@@ -12,15 +17,36 @@ import (
 )
 
 var (
-	username string
+	username      string
+	passwordStdin bool
+	loginList     bool
 )
 
 // loginCmd represents the login command
 var loginCmd = &cobra.Command{
-	Use:   "login server-url",
+	Use:   "login [server-url]",
 	Short: "Register username/secret for the specified registry",
-	Long:  `Persists login information to the specified auth file`,
-	Args:  cobra.MinimumNArgs(1),
+	Long: `Persists login information to the specified auth file.
+
+	The server can be a registry or a repository path such as ghcr.io/myorg, so that
+	repositories on the same registry can use different credentials. The longest server
+	matching a repository is used.
+
+	Auth files in docker's format, such as ~/.docker/config.json or podman's auth.json, are
+	updated the way docker does: the credentials go to the credential helper configured for
+	the server in credHelpers or credsStore, or to auths otherwise.
+
+	The credentials are checked against the registry before they are saved. Credentials can
+	also be given without logging in through the ` + container.RegistryUserEnv + `, ` + container.RegistrySecretEnv + ` and
+	` + container.RegistryServerEnv + ` environment variables.
+
+	When pulling, the credentials for a registry are taken from the first of these with any for it:
+	  1. the environment variables above, if ` + container.RegistryServerEnv + ` applies to the registry
+	  2. the auth file given by --auth-file
+	  3. podman's auth file, $REGISTRY_AUTH_FILE if set, or else
+	     $XDG_RUNTIME_DIR/containers/auth.json and ~/.config/containers/auth.json
+	  4. docker's config, $DOCKER_CONFIG/config.json or ~/.docker/config.json`,
+	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var err error
 
@@ -29,29 +55,92 @@ var loginCmd = &cobra.Command{
 			return err
 		}
 
+		if loginList {
+			return listLogins(authFile)
+		}
+
+		if len(args) == 0 {
+			return errors.New("server-url is required")
+		}
+
 		if username == "" {
 			// assume this is a token, so we set the username to special string <token>
 			// Reference: https://github.com/google/go-containerregistry/blob/main/pkg/authn/README.md
 			username = "<token>"
 		}
 
-		fmt.Print("Secret: ")
-		bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+		secret, err := readSecret()
 		if err != nil {
 			return err
 		}
 
 		serverUrl := args[0]
 
+		if offlineMode {
+			logger.Warnf("Saving credentials for %s without validating them in offline mode", serverUrl)
+		} else if err := container.ValidateLogin(serverUrl, username, secret); err != nil {
+			return err
+		}
+
 		helper := &container.AuthHelper{AuthFile: authFile}
 
-		return helper.Add(serverUrl, username, string(bytePassword))
+		return helper.Add(serverUrl, username, secret)
 	},
 }
 
+// the secret is read from stdin with --password-stdin, which works without a
+// terminal, or prompted for otherwise
+func readSecret() (string, error) {
+	if passwordStdin {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+
+		secret := strings.TrimSuffix(string(data), "\n")
+		secret = strings.TrimSuffix(secret, "\r")
+		if secret == "" {
+			return "", errors.New("no secret given on stdin")
+		}
+		return secret, nil
+	}
+
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		return "", errors.New("stdin is not a terminal, use --password-stdin to read the secret from it")
+	}
+
+	fmt.Print("Secret: ")
+	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytePassword), nil
+}
+
+// print the servers with saved credentials and their usernames, never secrets
+func listLogins(authFile string) error {
+	helper := &container.AuthHelper{AuthFile: authFile}
+	entries, err := helper.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tUSERNAME\tHELPER")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", entry.Server, entry.Username, entry.Helper)
+	}
+	return w.Flush()
+}
+
 func init() {
 	rootCmd.AddCommand(loginCmd)
 
 	loginCmd.Flags().StringVar(&username, "username", "", "specify username. leave blank for tokens")
+	loginCmd.Flags().BoolVar(&passwordStdin, "password-stdin", false, "read the secret from stdin instead of prompting for it")
+	loginCmd.Flags().BoolVar(&loginList, "list", false, "list the registries with saved credentials and their usernames")
 	loginCmd.Flags().StringVar(&authFile, "auth-file", "~/.rcon/auth.json", "auth file (json) for accessing container registry")
+	addRegistryFlags(loginCmd)
 }
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/container"
+	"github.com/samirkut/rcon/utils"
+)
+
+var (
+	logoutAll bool
+)
+
+// logoutCmd represents the logout command
+var logoutCmd = &cobra.Command{
+	Use:   "logout [server-url]",
+	Short: "Remove the username/secret saved for the specified registry",
+	Long: `Removes login information from the specified auth file, or from the credential helper
+	holding it for auth files in docker's format`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		authFile, err = utils.ExpandPath(authFile)
+		if err != nil {
+			return err
+		}
+
+		if logoutAll == (len(args) > 0) {
+			return errors.New("specify either a server-url or --all")
+		}
+
+		helper := &container.AuthHelper{AuthFile: authFile}
+
+		if logoutAll {
+			return helper.RemoveAll()
+		}
+
+		return helper.Remove(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(logoutCmd)
+
+	logoutCmd.Flags().BoolVar(&logoutAll, "all", false, "remove the credentials for every registry")
+	logoutCmd.Flags().StringVar(&authFile, "auth-file", "~/.rcon/auth.json", "auth file (json) for accessing container registry")
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// nsRemoveCmd removes paths from within a user namespace. it is only used
+// internally for files owned by subordinate ids the current user cannot remove
+var nsRemoveCmd = &cobra.Command{
+	Use:    "ns-remove path...",
+	Short:  "Remove paths from within a user namespace",
+	Hidden: true,
+	Args:   cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if os.Args[0] != "ns" {
+			return errors.New("ns-remove can only be run within a namespace")
+		}
+
+		for _, path := range args {
+			logger.Tracef("Removing %s", path)
+			if err := utils.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(nsRemoveCmd)
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/container"
+	"github.com/samirkut/rcon/utils"
+)
+
+var (
+	pruneOlderThan time.Duration
+	pruneMaxSize   int64
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove unused data from the cache",
+	Long: `Removes image data and layers no longer referenced by any image ref. 
+	Optionally also removes images not used recently, or the least recently used images until the cache fits in a size limit`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		cacheDir, err = utils.EnsureDir(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		if cacheDir == "" {
+			return errors.New("--cache-dir is required")
+		}
+
+		refs, reclaimed, err := container.PruneImages(cacheDir, pruneOlderThan, pruneMaxSize, removeAll)
+		for _, ref := range refs {
+			fmt.Printf("Deleted: %s\n", ref)
+		}
+		fmt.Printf("Total reclaimed space: %s\n", utils.HumanSize(reclaimed))
+
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+
+	pruneCmd.Flags().StringVar(&cacheDir, "cache-dir", "~/.rcon/cache", "cache folder for images")
+	pruneCmd.Flags().DurationVar(&pruneOlderThan, "older-than", 0, "also remove images not used within this duration, e.g. 720h")
+	pruneCmd.Flags().Int64Var(&pruneMaxSize, "max-size", 0, "also remove least recently used images until the cache is at most this many bytes")
+}
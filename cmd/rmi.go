@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/container"
+	"github.com/samirkut/rcon/utils"
+)
+
+// rmiCmd represents the rmi command
+var rmiCmd = &cobra.Command{
+	Use:   "rmi image-path...",
+	Short: "Remove images from the cache",
+	Long: `Removes the provided image refs from the cache. 
+	The image data is only deleted once no other ref points to it`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		cacheDir, err = utils.EnsureDir(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		if cacheDir == "" {
+			return errors.New("--cache-dir is required")
+		}
+
+		for _, arg := range args {
+			imageRef, err := resolveImageRef(arg)
+			if err != nil {
+				return err
+			}
+
+			err = container.RemoveImage(cacheDir, imageRef, removeAll)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rmiCmd)
+
+	rmiCmd.Flags().StringVar(&cacheDir, "cache-dir", "~/.rcon/cache", "cache folder for images")
+	rmiCmd.Flags().StringVar(&lockFile, "lock-file", "rcon.lock", "lock file pinning image refs to digests, used if it exists")
+	rmiCmd.Flags().StringVar(&platform, "platform", "", "platform to remove from a multi-arch image as os/arch[/variant], defaults to linux/amd64")
+}
@@ -1,15 +1,30 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/spf13/cobra"
 
+	"github.com/samirkut/rcon/container"
 	"github.com/samirkut/rcon/utils"
 )
 
 var (
 	verboseLogging, quietLogging bool
+	offlineMode                  bool
+	registriesFile               string
+	progressMode                 string
+	fetchJobs                    int
+	fetchTimeout                 time.Duration
 )
 
+// enables offline mode like --offline when set to a true value
+const offlineEnv = "RCON_OFFLINE"
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "rcon",
@@ -18,7 +33,7 @@ var rootCmd = &cobra.Command{
 	
 	The focus is on creating a runtime which can work with older kernels where podman won't work. 
 	This of course comes at a cost but in some cases the trade-off is probably worth it.`,
-	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		if verboseLogging {
 			utils.SetLoggerVerbose()
 		}
@@ -26,6 +41,46 @@ var rootCmd = &cobra.Command{
 		if quietLogging {
 			utils.SetLoggerQuiet()
 		}
+
+		if env := os.Getenv(offlineEnv); env != "" && !offlineMode {
+			enabled, err := strconv.ParseBool(env)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %w", offlineEnv, err)
+			}
+			offlineMode = enabled
+		}
+		container.SetOffline(offlineMode)
+
+		path, err := utils.ExpandPath(registriesFile)
+		if err != nil {
+			return err
+		}
+		container.SetRegistriesFile(path)
+
+		authKeyFile, err = utils.ExpandPath(authKeyFile)
+		if err != nil {
+			return err
+		}
+		container.SetAuthKeyFile(authKeyFile)
+
+		// a live display would be garbled by verbose logs
+		if progressMode == container.ProgressAuto && quietLogging {
+			progressMode = container.ProgressNone
+		} else if progressMode == container.ProgressAuto && verboseLogging {
+			progressMode = container.ProgressPlain
+		}
+		if err := container.SetProgress(progressMode); err != nil {
+			return err
+		}
+
+		if fetchJobs < 1 {
+			return errors.New("--jobs must be at least 1")
+		}
+		container.SetFetchJobs(fetchJobs)
+		container.SetFetchTimeout(fetchTimeout)
+
+		// commands re-executed in a new namespace may need to wait for their id mappings
+		return nsAwaitIDMappings()
 	},
 }
 
@@ -38,4 +93,23 @@ func Execute() {
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&verboseLogging, "verbose", "v", false, "enable verbose logging")
 	rootCmd.PersistentFlags().BoolVarP(&quietLogging, "quiet", "q", false, "disable logging")
+	rootCmd.PersistentFlags().StringVar(&authKeyFile, "auth-key-file", "", "key file for an encrypted auth file, "+container.AuthPassphraseEnv+" is used as passphrase if not set")
+	rootCmd.PersistentFlags().BoolVar(&offlineMode, "offline", false, "only use cached images and never contact a registry, also enabled by "+offlineEnv+"=1")
+}
+
+// flags of the commands contacting registries
+func addRegistryFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&registriesFile, "registries-file", "~/.rcon/registries.json", "config file (json) with mirrors, insecure and ca settings per registry")
+}
+
+// flags of the commands fetching images
+func addFetchFlags(cmd *cobra.Command) {
+	addRegistryFlags(cmd)
+	addProgressFlag(cmd)
+	cmd.Flags().IntVar(&fetchJobs, "jobs", 4, "number of layers to download at once")
+	cmd.Flags().DurationVar(&fetchTimeout, "fetch-timeout", 0, "total time allowed for fetching an image including retries, e.g. 10m, no limit if 0")
+}
+
+func addProgressFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&progressMode, "progress", container.ProgressAuto, "how to show download progress on stderr: auto, tty, plain, json or none")
 }
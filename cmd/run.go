@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/sys/unix"
@@ -30,12 +32,32 @@ type BindMount struct {
 var (
 	logger = utils.MustGetLogger()
 
-	cacheDir  string
-	runDir    string
-	authFile  string
-	mounts    = []string{}
-	extraEnvs = []string{}
-	skipCache bool
+	cacheDir   string
+	runDir     string
+	authFile   string
+	mounts     = []string{}
+	extraEnvs  = []string{}
+	skipCache  bool
+	verifyRun  bool
+	platform   string
+	workDir    string
+	userSpec   string
+	usernsMode string
+	rootFSMode string
+	rootFSSize int64
+)
+
+const (
+	usernsSingle = "single"
+	usernsSubID  = "subid"
+	usernsKeepID = "keep-id"
+
+	// set for the namespaced child when it has to wait for newuidmap/newgidmap
+	nsSyncEnv = "_RCON_NS_SYNC_FD"
+	// per-run dir created by the parent for the namespaced child
+	nsContainerDirEnv = "_RCON_CONTAINER_DIR"
+	// set for the namespaced child when rcon runs in the foreground of a terminal
+	nsForegroundEnv = "_RCON_FOREGROUND"
 )
 
 // runCmd represents the run command
@@ -96,33 +118,109 @@ var runCmd = &cobra.Command{
 			}
 		}
 
+		if usernsMode != usernsSingle && usernsMode != usernsSubID && usernsMode != usernsKeepID {
+			return fmt.Errorf("unknown --userns-mode %s", usernsMode)
+		}
+
+		imageRef, err := resolveImageRef(args[0])
+		if err != nil {
+			return err
+		}
+
 		if os.Args[0] != "ns" {
+			// each run gets its own dir under run-dir holding its state and rootfs.
+			// it is created and removed here since the namespaced child cannot
+			// reach it after pivoting
+			id, err := container.NewContainerID()
+			if err != nil {
+				return err
+			}
+
+			containerDir, err := container.CreateRunDir(runDir, &container.State{
+				ID:         id,
+				Image:      imageRef,
+				Pid:        os.Getpid(),
+				Created:    time.Now(),
+				RootFSMode: rootFSMode,
+			})
+			if err != nil {
+				return err
+			}
+			os.Setenv(nsContainerDirEnv, containerDir)
+			if inForeground() {
+				os.Setenv(nsForegroundEnv, "1")
+			}
+
+			// held until the run dir is removed, keeping the image in use
+			runLock, err := container.LockRun(containerDir)
+			if err != nil {
+				return err
+			}
+			defer runLock.Unlock()
+
 			logger.Tracef("Forking with NS enabled")
 			//reexec with namespace attrs
 			args := []string{"ns"}
 			args = append(args, os.Args[1:]...)
 			cmd := reexecCmd(args...)
 
-			err := cmd.Run()
+			err = runWithIDMappings(cmd)
+
+			if relErr := container.ReleaseRun(cacheDir, id); relErr != nil {
+				logger.Warnf("Failed to release cached image: %v", relErr)
+			}
+
+			logger.Tracef("Removing %s", containerDir)
+			if rmErr := removeAll(containerDir); rmErr != nil {
+				logger.Warnf("Failed to remove %s: %v", containerDir, rmErr)
+			}
+
 			if err != nil {
 				// suppress help from being shown by returning nil
 				// but lets propogate the exit code
 				if exitErr, ok := err.(*exec.ExitError); ok {
+					// as shells report processes killed by a signal
+					if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+						os.Exit(128 + int(status.Signal()))
+					}
 					os.Exit(exitErr.ExitCode())
 				}
+				// errors setting up the namespace happen before the child runs
+				return err
 			}
 			return nil
 		}
 
 		// all the lines below run within a new namespace
-		imageRef := args[0]
-
 		err = container.FetchContainer(imageRef, cacheDir, authFile, skipCache)
 		if err != nil {
 			return err
 		}
 
-		rootFS, cfg, err := container.PrepContainer(imageRef, cacheDir, runDir)
+		if verifyRun {
+			// files extracted from images are owned by ids mapped into this namespace
+			issues, err := verifyImage(imageRef, true, utils.RemoveAll)
+			if err != nil {
+				return err
+			}
+
+			for _, issue := range issues {
+				if !issue.Repaired {
+					return fmt.Errorf("cached image is corrupted: %s", issue.Problem)
+				}
+				logger.Warnf("Repaired: %s", issue.Problem)
+			}
+		}
+
+		// keep the image in the cache while it is in use
+		containerDir := os.Getenv(nsContainerDirEnv)
+		err = container.RegisterRun(cacheDir, imageRef, containerDir)
+		if err != nil {
+			return err
+		}
+
+		rootFS := container.GetRootFSDir(containerDir)
+		rootFS, cfg, err := container.PrepContainer(imageRef, cacheDir, rootFS, rootFSMode, rootFSSize)
 		if err != nil {
 			return err
 		}
@@ -139,6 +237,16 @@ var runCmd = &cobra.Command{
 			return err
 		}
 
+		// switch to the working directory, creating it if the image does not have it
+		wd := cfg.WorkingDir
+		if workDir != "" {
+			wd = workDir
+		}
+		err = nsChdir(wd)
+		if err != nil {
+			return err
+		}
+
 		// run the command - ignore args[0] since thats the image ref
 		cmdArgs := args[1:]
 		if len(cmdArgs) == 0 {
@@ -153,8 +261,41 @@ var runCmd = &cobra.Command{
 			return errors.New("no command to run")
 		}
 
+		// keep-id runs the process in a nested user namespace where the invoking
+		// user appears with their own uid/gid, and runs as that user by default
+		spec := cfg.User
+		var nested *container.IDMappings
+		if usernsMode == usernsKeepID {
+			var uid, gid int
+			nested, uid, gid, err = keepIDMappings()
+			if err != nil {
+				return err
+			}
+			spec = fmt.Sprintf("%d:%d", uid, gid)
+		}
+
+		// resolve the user to run as against the container's passwd/group files
+		if userSpec != "" {
+			spec = userSpec
+		}
+		user, err := container.LookupUser("/", spec)
+		if err != nil {
+			return err
+		}
+
+		// keep-id maps the user in the nested namespace instead
+		if nested == nil {
+			user, err = mappedUser(user, spec)
+			if err != nil {
+				return err
+			}
+		}
+
 		//process env to be passed in
 		env := cfg.Env
+		if utils.Findenv(env, "HOME") == "" {
+			env = append(env, "HOME="+user.Home)
+		}
 		for _, e := range extraEnvs {
 			if strings.Contains(e, "=") {
 				env = append(env, e)
@@ -163,19 +304,28 @@ var runCmd = &cobra.Command{
 			}
 		}
 
-		return nsRun(cmdArgs[0], cmdArgs, env)
+		return nsRun(cmdArgs[0], cmdArgs, env, user, nested)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(runCmd)
 
-	runCmd.Flags().StringVar(&runDir, "run-dir", "~/.rcon/run", "cache folder for images")
+	runCmd.Flags().StringVar(&runDir, "run-dir", "~/.rcon/run", "folder holding a dir with the state and rootfs of each running container")
 	runCmd.Flags().StringVar(&cacheDir, "cache-dir", "~/.rcon/cache", "cache folder for images")
 	runCmd.Flags().StringVar(&authFile, "auth-file", "~/.rcon/auth.json", "auth file (json) for accessing container registry")
 	runCmd.Flags().BoolVar(&skipCache, "skip-cache", false, "refetch image from server instead of using cache")
+	runCmd.Flags().StringVar(&lockFile, "lock-file", "rcon.lock", "lock file pinning image refs to digests, used if it exists")
+	runCmd.Flags().StringVar(&platform, "platform", "", "platform to run from a multi-arch image as os/arch[/variant], defaults to linux/amd64")
+	runCmd.Flags().BoolVar(&verifyRun, "verify", false, "verify the digests of the cached image before running it, fetching corrupted files again")
 	runCmd.Flags().StringArrayVar(&mounts, "mount", nil, "mounts to pass in specified as host_path:container_path for bind mounts, or just container_path:tmpfs:size_bytes for tmpfs")
 	runCmd.Flags().StringArrayVar(&extraEnvs, "env", nil, "specify extra env vars to be injected in the form var=value. if specified simply as var then the value is deduced from current env")
+	runCmd.Flags().StringVarP(&workDir, "workdir", "w", "", "working directory inside the container. defaults to the WorkingDir set in the image")
+	runCmd.Flags().StringVarP(&userSpec, "user", "u", "", "user to run as inside the container in the form user[:group] (names or ids). defaults to the User set in the image")
+	runCmd.Flags().StringVar(&rootFSMode, "rootfs-mode", container.RootFSTmpfs, "how the container rootfs is set up: tmpfs (extract the image on every run), dir (extract the image into the container's dir under run-dir, for images larger than memory) or overlay (extract layers once into the cache and mount them with overlayfs, falling back to tmpfs if unsupported)")
+	runCmd.Flags().Int64Var(&rootFSSize, "rootfs-size", 0, "size in bytes of the tmpfs backing the rootfs. defaults to roughly 10x the image size")
+	runCmd.Flags().StringVar(&usernsMode, "userns-mode", usernsSingle, "user namespace mapping: single (only root is mapped to the current user), subid (map the subordinate ids from /etc/subuid and /etc/subgid) or keep-id (like subid but the current user keeps their id inside the container)")
+	addFetchFlags(runCmd)
 }
 
 // reference from https://github.com/moby/moby/blob/master/pkg/reexec/command_linux.go
@@ -215,6 +365,206 @@ func reexecCmd(args ...string) *exec.Cmd {
 	}
 }
 
+// Start the namespaced child and wait for it. unless running in single mode the
+// child's id mappings are set up with newuidmap/newgidmap instead of the
+// single id mapping set in reexecCmd
+func runWithIDMappings(cmd *exec.Cmd) error {
+	if usernsMode == usernsSingle {
+		return runChild(cmd)
+	}
+
+	return runWithSubIDMappings(cmd)
+}
+
+// Start the namespaced child with the current user's subordinate ids mapped,
+// falling back to the single id mapping if they are not available
+func runWithSubIDMappings(cmd *exec.Cmd) error {
+	uidMaps, gidMaps, err := subIDMappings()
+	if err != nil {
+		logger.Warnf("Cannot use subordinate ids, falling back to single id mapping: %v", err)
+		return runChild(cmd)
+	}
+
+	sigs := notifySignals()
+	defer signal.Stop(sigs)
+
+	// the child blocks on this pipe until its mappings are in place
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer syncW.Close()
+
+	cmd.SysProcAttr.UidMappings = nil
+	cmd.SysProcAttr.GidMappings = nil
+	cmd.ExtraFiles = []*os.File{syncR}
+	cmd.Env = append(os.Environ(), nsSyncEnv+"=3")
+
+	err = cmd.Start()
+	_ = syncR.Close()
+	if err != nil {
+		return err
+	}
+
+	err = container.WriteIDMappings(cmd.Process.Pid, uidMaps, gidMaps)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+
+	if _, err = syncW.Write([]byte{0}); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+
+	return waitChild(cmd, sigs)
+}
+
+// Start a child and wait for it, see waitChild
+func runChild(cmd *exec.Cmd) error {
+	sigs := notifySignals()
+	defer signal.Stop(sigs)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	return waitChild(cmd, sigs)
+}
+
+// Signals which would otherwise kill rcon before its child exits: the parent
+// could not clean up after the container, and the namespaced child is pid 1 of
+// its namespace, whose exit kills the container outright
+func notifySignals() chan os.Signal {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	return sigs
+}
+
+// Wait for the child, passing on the signals received on sigs so that it exits
+// first. the terminal already sends SIGINT and SIGHUP to every process in the
+// foreground, including the container, so those are only passed on otherwise
+func waitChild(cmd *exec.Cmd, sigs chan os.Signal) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case sig := <-sigs:
+			if (sig == syscall.SIGINT || sig == syscall.SIGHUP) && inForeground() {
+				logger.Tracef("Received %s, waiting for the container to exit", sig)
+				continue
+			}
+			logger.Tracef("Forwarding %s to pid %d", sig, cmd.Process.Pid)
+			_ = cmd.Process.Signal(sig)
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+// Whether rcon runs in the foreground process group of its terminal. the
+// namespaced child cannot see process groups outside its pid namespace, so it
+// is told by the parent
+func inForeground() bool {
+	if os.Args[0] == "ns" {
+		return os.Getenv(nsForegroundEnv) != ""
+	}
+
+	pgrp, err := unix.IoctlGetInt(int(os.Stdin.Fd()), unix.TIOCGPGRP)
+	return err == nil && pgrp == unix.Getpgrp()
+}
+
+// Remove a path created inside a user namespace. files owned by ids other than
+// container root map to subordinate ids on the host, so if that fails the
+// removal is retried from within a user namespace using those ids
+func removeAll(path string) error {
+	err := utils.RemoveAll(path)
+	if err == nil {
+		return nil
+	}
+
+	if _, _, mapErr := subIDMappings(); mapErr != nil {
+		return err
+	}
+
+	logger.Tracef("Retrying removal of %s within user namespace: %v", path, err)
+	return runWithSubIDMappings(reexecCmd("ns", nsRemoveCmd.Name(), path))
+}
+
+// Subordinate id mappings for the current user
+func subIDMappings() ([]syscall.SysProcIDMap, []syscall.SysProcIDMap, error) {
+	if !container.IDMapHelpersAvailable() {
+		return nil, nil, errors.New("newuidmap/newgidmap not found in PATH")
+	}
+
+	uidMaps, err := container.SubIDMappings("/etc/subuid", os.Getuid())
+	if err != nil {
+		return nil, nil, fmt.Errorf("/etc/subuid: %w", err)
+	}
+
+	gidMaps, err := container.SubIDMappings("/etc/subgid", os.Getgid())
+	if err != nil {
+		return nil, nil, fmt.Errorf("/etc/subgid: %w", err)
+	}
+
+	return uidMaps, gidMaps, nil
+}
+
+// Wait for the parent to write our id mappings if requested. the process was
+// started before it was mapped to root and so has no capabilities in the
+// namespace - exec ourselves again now that we are root to pick them up
+func nsAwaitIDMappings() error {
+	if os.Getenv(nsSyncEnv) == "" {
+		return nil
+	}
+
+	sync := os.NewFile(3, "ns-sync")
+	buf := make([]byte, 1)
+	n, _ := sync.Read(buf)
+	_ = sync.Close()
+	if n != 1 {
+		return errors.New("user namespace id mappings were not set up")
+	}
+
+	if err := os.Unsetenv(nsSyncEnv); err != nil {
+		return err
+	}
+
+	logger.Tracef("Id mappings in place, re-executing as namespace root")
+	return syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+}
+
+// Mappings for a nested user namespace in which the invoking user keeps their
+// uid/gid. returns the mappings along with that uid and gid
+func keepIDMappings() (*container.IDMappings, int, int, error) {
+	outerUid, err := container.ReadIDMappings("/proc/self/uid_map")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	outerGid, err := container.ReadIDMappings("/proc/self/gid_map")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	uidMaps, uid, err := container.KeepIDMappings(outerUid)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	gidMaps, gid, err := container.KeepIDMappings(outerGid)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return &container.IDMappings{Uid: uidMaps, Gid: gidMaps}, uid, gid, nil
+}
+
 // Initialize namespace
 func nsInitialisation(rootFS string, hostname string, bindMounts []BindMount, tmpfsMounts []TmpfsMount) error {
 	logger.Tracef("Initialize namespace and mounts")
@@ -252,8 +602,22 @@ func nsInitialisation(rootFS string, hostname string, bindMounts []BindMount, tm
 	return nil
 }
 
-// Run command in namespace
-func nsRun(name string, args []string, env []string) error {
+// Change to the working directory within the new root
+func nsChdir(wd string) error {
+	// relative paths are treated as relative to the container root
+	wd = filepath.Join("/", wd)
+
+	logger.Tracef("set container working directory to %s", wd)
+	if err := os.MkdirAll(wd, 0755); err != nil {
+		return err
+	}
+
+	return os.Chdir(wd)
+}
+
+// Run command in namespace. if nested is set the command gets its own user
+// namespace with those mappings
+func nsRun(name string, args []string, env []string, user *container.User, nested *container.IDMappings) error {
 	// get path if set in env. if not the findExecInPath will fallback to current env
 	// set for this process - which may not make much sense in a container
 	pathEnv := utils.Findenv(env, "PATH")
@@ -279,5 +643,86 @@ func nsRun(name string, args []string, env []string) error {
 		},
 	}
 
-	return cmd.Run()
+	if nested != nil {
+		logger.Tracef("Launching in nested user namespace, uid map: %v, gid map: %v", nested.Uid, nested.Gid)
+		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = nested.Uid
+		cmd.SysProcAttr.GidMappings = nested.Gid
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = setgroupsAllowed()
+	}
+
+	// only switch credentials if we are not running as container root
+	if user.Uid != 0 || user.Gid != 0 || len(user.Groups) != 0 {
+		logger.Tracef("Running as uid: %d, gid: %d, groups: %v", user.Uid, user.Gid, user.Groups)
+		cred := &syscall.Credential{
+			Uid:    user.Uid,
+			Gid:    user.Gid,
+			Groups: user.Groups,
+		}
+
+		// setgroups is denied in user namespaces where the gid map was written
+		// without the newgidmap helper. supplementary groups cannot be applied then
+		if !setgroupsAllowed() {
+			if len(user.Groups) != 0 {
+				logger.Warnf("setgroups is not permitted in this namespace, ignoring supplementary groups %v", user.Groups)
+			}
+			cred.Groups = nil
+			cred.NoSetGroups = true
+		}
+
+		cmd.SysProcAttr.Credential = cred
+	}
+
+	err = runChild(&cmd)
+	if err != nil && errors.Is(err, syscall.EINVAL) {
+		return fmt.Errorf("cannot run as uid %d, gid %d (not mapped in user namespace?): %w", user.Uid, user.Gid, err)
+	}
+
+	return err
+}
+
+// The user to run as, which must be mapped in the user namespace. only root
+// is with the single id mapping, so images with a User run as root then unless
+// the user was asked for with --user. unmapped supplementary groups are dropped
+func mappedUser(user *container.User, spec string) (*container.User, error) {
+	uidMaps, err := container.ReadIDMappings("/proc/self/uid_map")
+	if err != nil {
+		return nil, err
+	}
+
+	gidMaps, err := container.ReadIDMappings("/proc/self/gid_map")
+	if err != nil {
+		return nil, err
+	}
+
+	if !container.IDMapped(uidMaps, user.Uid) || !container.IDMapped(gidMaps, user.Gid) {
+		if userSpec != "" {
+			return nil, fmt.Errorf("user %s (uid %d, gid %d) is not mapped in the user namespace, try --userns-mode subid", spec, user.Uid, user.Gid)
+		}
+
+		logger.Warnf("Image user %s (uid %d, gid %d) is not mapped in the user namespace, running as root. use --userns-mode subid to run as the image user", spec, user.Uid, user.Gid)
+		return container.LookupUser("/", "0")
+	}
+
+	groups := []uint32{}
+	for _, gid := range user.Groups {
+		if container.IDMapped(gidMaps, gid) {
+			groups = append(groups, gid)
+		} else {
+			logger.Tracef("Dropping supplementary group %d, not mapped in the user namespace", gid)
+		}
+	}
+	user.Groups = groups
+
+	return user, nil
+}
+
+func setgroupsAllowed() bool {
+	data, err := os.ReadFile("/proc/self/setgroups")
+	if err != nil {
+		// older kernels do not have this file and always allow setgroups
+		return true
+	}
+
+	return strings.TrimSpace(string(data)) == "allow"
 }
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/container"
+	"github.com/samirkut/rcon/utils"
+)
+
+var (
+	saveOutput string
+	saveFormat string
+)
+
+// saveCmd represents the save command
+var saveCmd = &cobra.Command{
+	Use:   "save image-path... -o path",
+	Short: "Save images to a docker-compatible tarball or an OCI image layout",
+	Long: `Writes the provided images to a tarball in the format of docker save, or an OCI image layout directory, fetching them first if they are not cached. 
+	The output can be loaded by rcon load, docker load or other tools on machines without registry access`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		cacheDir, err = utils.EnsureDir(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		if cacheDir == "" {
+			return errors.New("--cache-dir is required")
+		}
+
+		authFile, err = utils.ExpandPath(authFile)
+		if err != nil {
+			return err
+		}
+
+		saveOutput, err = utils.ExpandPath(saveOutput)
+		if err != nil {
+			return err
+		}
+
+		if saveOutput == "" {
+			return errors.New("--output is required")
+		}
+
+		images := []container.SavedImage{}
+		for _, arg := range args {
+			imageRef, err := resolveImageRef(arg)
+			if err != nil {
+				return err
+			}
+
+			err = container.FetchContainer(imageRef, cacheDir, authFile, false)
+			if err != nil {
+				return err
+			}
+
+			// images are saved under the name they were requested by, rather
+			// than the digest they are pinned to
+			images = append(images, container.SavedImage{Ref: imageRef, Name: arg})
+		}
+
+		return container.SaveImages(cacheDir, saveOutput, saveFormat, images)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(saveCmd)
+
+	saveCmd.Flags().StringVar(&cacheDir, "cache-dir", "~/.rcon/cache", "cache folder for images")
+	saveCmd.Flags().StringVar(&authFile, "auth-file", "~/.rcon/auth.json", "auth file (json) for accessing container registry")
+	saveCmd.Flags().StringVar(&lockFile, "lock-file", "rcon.lock", "lock file pinning image refs to digests, used if it exists")
+	saveCmd.Flags().StringVar(&platform, "platform", "", "platform to save from multi-arch images as os/arch[/variant], defaults to linux/amd64")
+	saveCmd.Flags().StringVarP(&saveOutput, "output", "o", "", "file or directory to write to")
+	saveCmd.Flags().StringVar(&saveFormat, "format", container.FormatDockerArchive, "output format: docker-archive (a tarball as written by docker save) or oci (an OCI image layout directory)")
+	addFetchFlags(saveCmd)
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/samirkut/rcon/container"
+	"github.com/samirkut/rcon/utils"
+)
+
+var verifyDryRun bool
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [image-path...]",
+	Short: "Verify the integrity of cached images",
+	Long: `Recomputes the digests of the config and layers cached for the provided image refs, or all cached refs if none are provided. 
+	Corrupted files are removed and the image is fetched again. Layers extracted from corrupted files are removed as well, to be extracted again by the next run`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+
+		cacheDir, err = utils.EnsureDir(cacheDir)
+		if err != nil {
+			return err
+		}
+
+		if cacheDir == "" {
+			return errors.New("--cache-dir is required")
+		}
+
+		authFile, err = utils.ExpandPath(authFile)
+		if err != nil {
+			return err
+		}
+
+		refs := []string{}
+		for _, arg := range args {
+			imageRef, err := resolveImageRef(arg)
+			if err != nil {
+				return err
+			}
+			refs = append(refs, imageRef)
+		}
+
+		if len(refs) == 0 {
+			images, err := container.ListImages(cacheDir)
+			if err != nil {
+				return err
+			}
+			for _, img := range images {
+				refs = append(refs, img.Ref)
+			}
+		}
+
+		found := 0
+		for _, imageRef := range refs {
+			issues, err := verifyImage(imageRef, !verifyDryRun, removeAll)
+			for _, issue := range issues {
+				if issue.Repaired {
+					fmt.Printf("Repaired: %s\n", issue.Problem)
+				} else {
+					fmt.Printf("Found: %s\n", issue.Problem)
+					found++
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if found > 0 {
+			return fmt.Errorf("found %d corrupted files", found)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVar(&cacheDir, "cache-dir", "~/.rcon/cache", "cache folder for images")
+	verifyCmd.Flags().StringVar(&authFile, "auth-file", "~/.rcon/auth.json", "auth file (json) for accessing container registry")
+	verifyCmd.Flags().StringVar(&lockFile, "lock-file", "rcon.lock", "lock file pinning image refs to digests, used if it exists")
+	verifyCmd.Flags().StringVar(&platform, "platform", "", "platform of multi-arch images to verify as os/arch[/variant], defaults to linux/amd64")
+	verifyCmd.Flags().BoolVar(&verifyDryRun, "dry-run", false, "only report corrupted files without fetching them again")
+	addFetchFlags(verifyCmd)
+}
+
+// verify the cached content of imageRef. with repair set, corrupted files are
+// removed and fetched again, unless offline where they cannot be fetched
+func verifyImage(imageRef string, repair bool, remove container.Remover) ([]container.CacheIssue, error) {
+	repair = repair && !offlineMode
+	issues, err := container.VerifyImage(cacheDir, imageRef, repair, remove)
+	if err != nil || !repair || len(issues) == 0 {
+		return issues, err
+	}
+
+	return issues, container.FetchContainer(imageRef, cacheDir, authFile, true)
+}
@@ -0,0 +1,296 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// images can be loaded from local files instead of a registry with refs like
+// oci:/path/to/layout:tag or docker-archive:/path/to/file.tar:ubuntu:22.04.
+// the tag is optional if the file holds a single image
+const (
+	ociLayoutPrefix     = "oci:"
+	dockerArchivePrefix = "docker-archive:"
+)
+
+// annotations naming the images in an oci layout
+const (
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	containerdAnnotation = "io.containerd.image.name"
+)
+
+func isArchiveRef(imageRef string) bool {
+	return strings.HasPrefix(imageRef, ociLayoutPrefix) || strings.HasPrefix(imageRef, dockerArchivePrefix)
+}
+
+// NormalizeRef makes the path in oci: and docker-archive: refs absolute, so
+// that the same file is cached under one ref wherever rcon is run from
+func NormalizeRef(imageRef string) (string, error) {
+	prefix, path, tag := splitArchiveRef(imageRef)
+	if prefix == "" {
+		return imageRef, nil
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	return archiveRef(prefix, path, tag), nil
+}
+
+// split an archive ref into its prefix, path and tag. the prefix is empty for
+// registry refs
+func splitArchiveRef(imageRef string) (string, string, string) {
+	prefix := ""
+	for _, p := range []string{ociLayoutPrefix, dockerArchivePrefix} {
+		if strings.HasPrefix(imageRef, p) {
+			prefix = p
+		}
+	}
+	if prefix == "" {
+		return "", "", ""
+	}
+
+	// the tag may contain colons itself, e.g. a docker image name
+	path, tag, _ := strings.Cut(strings.TrimPrefix(imageRef, prefix), ":")
+	return prefix, path, tag
+}
+
+func archiveRef(prefix, path, tag string) string {
+	if tag == "" {
+		return prefix + path
+	}
+	return prefix + path + ":" + tag
+}
+
+// load the image for an oci: or docker-archive: ref. also returns the index the
+// image was selected from, if any
+func loadArchiveImage(imageRef string, platform *v1.Platform) (v1.Image, *indexSource, error) {
+	prefix, path, tag := splitArchiveRef(imageRef)
+	if prefix == dockerArchivePrefix {
+		if platform != nil {
+			return nil, nil, fmt.Errorf("cannot select a platform from docker archive %s", path)
+		}
+		img, err := loadDockerArchiveImage(path, tag)
+		return img, nil, err
+	}
+
+	idx, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tags := []string{}
+	for _, desc := range manifest.Manifests {
+		refName := desc.Annotations[ociRefNameAnnotation]
+		matches := tag != "" && (refName == tag || desc.Annotations[containerdAnnotation] == tag)
+		if matches || (tag == "" && len(manifest.Manifests) == 1) {
+			return ociLayoutImage(idx, desc, imageRef, platform)
+		}
+		tags = append(tags, refName)
+	}
+
+	if tag == "" {
+		return nil, nil, fmt.Errorf("oci layout %s holds several images, choose one of the tags: %s", path, strings.Join(tags, ", "))
+	}
+
+	return nil, nil, fmt.Errorf("tag %s not found in oci layout %s, available tags: %s", tag, path, strings.Join(tags, ", "))
+}
+
+// the image for desc in an oci layout, along with the index it was selected
+// from if desc is one
+func ociLayoutImage(idx v1.ImageIndex, desc v1.Descriptor, imageRef string, platform *v1.Platform) (v1.Image, *indexSource, error) {
+	if !desc.MediaType.IsIndex() {
+		if platform != nil && desc.Platform != nil && !platformMatches(*desc.Platform, platform) {
+			return nil, nil, fmt.Errorf("platform %s not available for %s, it is a single platform image for %s", platform, imageRef, desc.Platform)
+		}
+		img, err := idx.Image(desc.Digest)
+		return img, nil, err
+	}
+
+	child, err := idx.ImageIndex(desc.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return imageForPlatform(child, desc.Digest, imageRef, platform)
+}
+
+func loadDockerArchiveImage(path, tag string) (v1.Image, error) {
+	if tag == "" {
+		return tarball.ImageFromPath(path, nil)
+	}
+
+	manifest, err := loadDockerArchiveManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	want, err := name.NewTag(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	// tags are stored as written by docker save, e.g. ubuntu:22.04
+	tags := []string{}
+	for _, desc := range manifest {
+		for _, repoTag := range desc.RepoTags {
+			t, err := name.NewTag(repoTag)
+			if err == nil && t.Name() == want.Name() {
+				return tarball.ImageFromPath(path, &t)
+			}
+			tags = append(tags, repoTag)
+		}
+	}
+
+	return nil, fmt.Errorf("tag %s not found in docker archive %s, available tags: %s", tag, path, strings.Join(tags, ", "))
+}
+
+func loadDockerArchiveManifest(path string) (tarball.Manifest, error) {
+	return tarball.LoadManifest(func() (io.ReadCloser, error) {
+		return os.Open(path)
+	})
+}
+
+// LoadArchive imports every image in a docker save tarball or an oci layout
+// dir at path into the cache. images are cached under the name they were saved
+// with, or an archive ref for the path if they have none. returns the refs
+func LoadArchive(path, cacheDir string) ([]string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := rlockCache(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	replaced := false
+	if info.IsDir() {
+		refs, replaced, err = loadOCILayout(path, cacheDir)
+	} else {
+		refs, replaced, err = loadDockerArchive(path, cacheDir)
+	}
+	lock.Unlock()
+	if err != nil {
+		return refs, err
+	}
+
+	if replaced {
+		return refs, removeUnusedImages(cacheDir)
+	}
+
+	return refs, nil
+}
+
+func loadOCILayout(path, cacheDir string) ([]string, bool, error) {
+	idx, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, false, err
+	}
+
+	refs := []string{}
+	anyReplaced := false
+	for _, desc := range manifest.Manifests {
+		refName := desc.Annotations[ociRefNameAnnotation]
+		if refName == "" && len(manifest.Manifests) > 1 {
+			logger.Warnf("Skipping untagged image %s in %s", desc.Digest, path)
+			continue
+		}
+
+		imageRef := archiveRef(ociLayoutPrefix, path, refName)
+		img, index, err := ociLayoutImage(idx, desc, imageRef, nil)
+		if err != nil {
+			return refs, anyReplaced, err
+		}
+
+		// images saved by containerd record their full name
+		imageRefs := []string{imageRef}
+		if imageName := desc.Annotations[containerdAnnotation]; imageName != "" {
+			imageRefs = append(imageRefs, imageName)
+		}
+
+		for _, imageRef := range imageRefs {
+			logger.Infof("Loading %s", imageRef)
+			replaced, err := storeImage(context.Background(), img, index, imageRef, cacheDir, nil)
+			if err != nil {
+				return refs, anyReplaced, err
+			}
+			anyReplaced = anyReplaced || replaced
+			refs = append(refs, imageRef)
+		}
+	}
+
+	return refs, anyReplaced, nil
+}
+
+func loadDockerArchive(path, cacheDir string) ([]string, bool, error) {
+	manifest, err := loadDockerArchiveManifest(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	refs := []string{}
+	anyReplaced := false
+	for _, desc := range manifest {
+		imageRefs := desc.RepoTags
+		var tag *name.Tag
+		if len(imageRefs) == 0 {
+			if len(manifest) > 1 {
+				logger.Warnf("Skipping untagged image %s in %s", desc.Config, path)
+				continue
+			}
+			imageRefs = []string{archiveRef(dockerArchivePrefix, path, "")}
+		} else {
+			t, err := name.NewTag(imageRefs[0])
+			if err != nil {
+				return refs, anyReplaced, err
+			}
+			tag = &t
+		}
+
+		img, err := tarball.ImageFromPath(path, tag)
+		if err != nil {
+			return refs, anyReplaced, err
+		}
+
+		for _, imageRef := range imageRefs {
+			logger.Infof("Loading %s", imageRef)
+			replaced, err := storeImage(context.Background(), img, nil, imageRef, cacheDir, nil)
+			if err != nil {
+				return refs, anyReplaced, err
+			}
+			anyReplaced = anyReplaced || replaced
+			refs = append(refs, imageRef)
+		}
+	}
+
+	return refs, anyReplaced, nil
+}
@@ -0,0 +1,189 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// auth files can be encrypted at rest, in which case they hold
+//
+//	{"encrypted": {"kdf": "scrypt", "n": 32768, "r": 8, "p": 1, "salt": "...", "nonce": "...", "data": "..."}}
+//
+// where data is the plaintext file sealed with nacl secretbox. the key is
+// derived with scrypt from the contents of the key file set by SetAuthKeyFile,
+// or the passphrase in AuthPassphraseEnv
+const AuthPassphraseEnv = "RCON_AUTH_PASSPHRASE"
+
+// scrypt parameters for newly encrypted files
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	authKeyFile string
+
+	// deriving keys is slow on purpose, and files are read for every registry
+	derivedKeysMu sync.Mutex
+	derivedKeys   = map[string]*[32]byte{}
+)
+
+type encryptedAuth struct {
+	Encrypted *sealedAuth `json:"encrypted"`
+}
+
+type sealedAuth struct {
+	KDF   string `json:"kdf"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// SetAuthKeyFile sets the file the key for encrypted auth files is derived
+// from. the passphrase in AuthPassphraseEnv is used if empty
+func SetAuthKeyFile(path string) {
+	authKeyFile = path
+}
+
+// GenerateAuthKeyFile writes a new random key to path, readable only by its
+// owner
+func GenerateAuthKeyFile(path string) error {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%x\n", key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// the sealed contents of an encrypted auth file, nil if it is plaintext
+func parseSealedAuth(data []byte) *sealedAuth {
+	var enc encryptedAuth
+	if err := json.Unmarshal(data, &enc); err != nil || enc.Encrypted == nil || enc.Encrypted.KDF == "" {
+		return nil
+	}
+
+	return enc.Encrypted
+}
+
+func (s *sealedAuth) open() ([]byte, error) {
+	if len(s.Nonce) != 24 {
+		return nil, errors.New("invalid nonce in encrypted auth file")
+	}
+
+	key, err := s.key()
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], s.Nonce)
+	plain, ok := secretbox.Open(nil, s.Data, &nonce, key)
+	if !ok {
+		return nil, errors.New("cannot decrypt auth file, wrong key or passphrase")
+	}
+
+	return plain, nil
+}
+
+// seal plain with a new nonce, keeping the salt and parameters of s
+func (s *sealedAuth) seal(plain []byte) ([]byte, error) {
+	key, err := s.key()
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	sealed := *s
+	sealed.Nonce = nonce[:]
+	sealed.Data = secretbox.Seal(nil, plain, &nonce, key)
+
+	return json.MarshalIndent(encryptedAuth{Encrypted: &sealed}, "", "  ")
+}
+
+// the key for s derived from the key file or passphrase
+func (s *sealedAuth) key() (*[32]byte, error) {
+	if s.KDF != "scrypt" {
+		return nil, fmt.Errorf("unknown kdf %s in encrypted auth file", s.KDF)
+	}
+
+	secret, err := authSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	cacheKey := fmt.Sprintf("%x:%x:%d:%d:%d", secret, s.Salt, s.N, s.R, s.P)
+	derivedKeysMu.Lock()
+	defer derivedKeysMu.Unlock()
+	if key, ok := derivedKeys[cacheKey]; ok {
+		return key, nil
+	}
+
+	derived, err := scrypt.Key(secret, s.Salt, s.N, s.R, s.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &[32]byte{}
+	copy(key[:], derived)
+	derivedKeys[cacheKey] = key
+	return key, nil
+}
+
+// a new sealedAuth with a random salt
+func newSealedAuth() (*sealedAuth, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	return &sealedAuth{KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: salt}, nil
+}
+
+func authSecret() ([]byte, error) {
+	if authKeyFile != "" {
+		data, err := os.ReadFile(authKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		secret := strings.TrimSpace(string(data))
+		if secret == "" {
+			return nil, fmt.Errorf("key file %s is empty", authKeyFile)
+		}
+		return []byte(secret), nil
+	}
+
+	if passphrase := os.Getenv(AuthPassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	return nil, fmt.Errorf("auth file is encrypted, set --auth-key-file or %s", AuthPassphraseEnv)
+}
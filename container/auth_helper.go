@@ -3,8 +3,12 @@ package container
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/samirkut/rcon/utils"
 )
 
@@ -18,58 +22,388 @@ type creds struct {
 	Secret   string `json:"secret"`
 }
 
+// AuthHelper looks up credentials in an auth file, which holds them per
+// registry server in rcon's own format
+//
+//	{"registry.corp": {"username": "me", "secret": "..."}}
+//
+// and/or the sections of docker's config.json, which podman uses too
+//
+//	{
+//	  "auths": {"registry.corp": {"auth": "<base64 of username:password>"}},
+//	  "credHelpers": {"123456789.dkr.ecr.us-east-1.amazonaws.com": "ecr-login"},
+//	  "credsStore": "desktop"
+//	}
+//
+// servers may be a registry or a repository path such as ghcr.io/myorg, so
+// that repositories on the same registry can use different credentials. the
+// credentials for a repository are those of the longest server applying to it,
+// see matchServer, across all sections. for that server they are the first
+// found of
+//  1. its rcon entry
+//  2. the docker-credential-<name> helper named for it in credHelpers
+//  3. the docker-credential-<name> helper named by credsStore
+//  4. its entry in auths
 type AuthHelper struct {
 	AuthFile string
 }
 
-func (a *AuthHelper) Get(serverURL string) (string, string, error) {
-	if a.AuthFile == "" {
-		return "", "", errNoAuthFile
-	}
+// Resolve implements authn.Keychain, matching servers against the repository
+// of target rather than only its registry
+func (a *AuthHelper) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return resolveWithHelper(a, target)
+}
 
-	data, err := ioutil.ReadFile(a.AuthFile)
+// Get returns the credentials for serverURL, a registry or repository
+func (a *AuthHelper) Get(serverURL string) (string, string, error) {
+	cfg, err := a.read()
 	if err != nil {
+		// the keychain ignores errors and falls back to anonymous access
+		logger.Warnf("Cannot read auth file %s: %v", a.AuthFile, err)
 		return "", "", err
 	}
 
-	mapCfg := make(map[string]creds)
-	err = json.Unmarshal(data, &mapCfg)
-	if err != nil {
-		return "", "", err
+	rconServers := []string{}
+	for server, raw := range cfg {
+		if isRconEntry(raw) {
+			rconServers = append(rconServers, server)
+		}
 	}
 
-	// check if imageRef exists
-	if c, ok := mapCfg[serverURL]; ok {
+	dockerCfg := &dockerConfig{}
+	if isDockerConfig(cfg) {
+		dockerCfg, err = parseDockerConfig(cfg)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	// the longest server wins whichever section it is in. rcon entries take
+	// precedence over docker's sections for the same server
+	servers := append(rconServers, dockerCfg.servers()...)
+	server, found := matchServer(servers, serverURL)
+	if key, ok := findServer(rconServers, server); found && ok {
+		var c creds
+		if err := json.Unmarshal(cfg[key], &c); err != nil {
+			return "", "", err
+		}
 		return c.Username, c.Secret, nil
 	}
 
-	return "", "", errAuthNotFound
+	if !isDockerConfig(cfg) {
+		return "", "", errAuthNotFound
+	}
+
+	return dockerCfg.get(serverURL, server, found)
+}
+
+// the authenticator for credentials from a helper, which authn.Helper does not
+// pass the repository to. the username of identity tokens is tokenUsername
+func resolveWithHelper(h authn.Helper, target authn.Resource) (authn.Authenticator, error) {
+	username, secret, err := h.Get(target.String())
+	if err != nil {
+		return authn.Anonymous, nil
+	}
+
+	return credsAuthenticator(username, secret), nil
 }
 
+func credsAuthenticator(username, secret string) authn.Authenticator {
+	if username == tokenUsername {
+		return authn.FromConfig(authn.AuthConfig{Username: username, IdentityToken: secret})
+	}
+	return authn.FromConfig(authn.AuthConfig{Username: username, Password: secret})
+}
+
+// AuthEntry is a server with credentials in an auth file
+type AuthEntry struct {
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	// Helper is the credential helper holding the secret, empty if it is in
+	// the auth file itself
+	Helper string `json:"helper,omitempty"`
+}
+
+// Add stores credentials for serverUrl. files with docker's sections get a
+// docker style entry, or the credentials are passed to their credential
+// helper. other settings in the file are kept as they are
 func (a *AuthHelper) Add(serverUrl, username, secret string) error {
-	if a.AuthFile == "" {
-		return errNoAuthFile
+	cfg, err := a.read()
+	if err != nil {
+		return err
 	}
 
-	mapCfg := make(map[string]creds)
+	if isDockerConfig(cfg) {
+		dockerCfg, err := parseDockerConfig(cfg)
+		if err != nil {
+			return err
+		}
 
-	if utils.PathExists(a.AuthFile) {
-		data, err := ioutil.ReadFile(a.AuthFile)
+		err = dockerCfg.add(serverUrl, username, secret)
 		if err != nil {
 			return err
 		}
 
-		err = json.Unmarshal(data, &mapCfg)
+		// an rcon entry would take precedence over the new credentials
+		removeRconEntries(cfg, serverUrl)
+		return a.writeDocker(cfg, dockerCfg)
+	}
+
+	data, err := json.Marshal(creds{Username: username, Secret: secret})
+	if err != nil {
+		return err
+	}
+	removeRconEntries(cfg, serverUrl)
+	cfg[serverUrl] = data
+
+	return a.write(cfg)
+}
+
+// Remove deletes the credentials for serverUrl, from the credential helper
+// holding them if any
+func (a *AuthHelper) Remove(serverUrl string) error {
+	cfg, err := a.read()
+	if err != nil {
+		return err
+	}
+
+	found := removeRconEntries(cfg, serverUrl)
+
+	if !isDockerConfig(cfg) {
+		if !found {
+			return fmt.Errorf("%w for %s in %s", errAuthNotFound, serverUrl, a.AuthFile)
+		}
+		return a.write(cfg)
+	}
+
+	dockerCfg, err := parseDockerConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	removed, err := dockerCfg.remove(serverUrl)
+	if err != nil {
+		return err
+	}
+	if !found && !removed {
+		return fmt.Errorf("%w for %s in %s", errAuthNotFound, serverUrl, a.AuthFile)
+	}
+
+	return a.writeDocker(cfg, dockerCfg)
+}
+
+// RemoveAll deletes the credentials for every server
+func (a *AuthHelper) RemoveAll() error {
+	entries, err := a.List()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// servers in credHelpers may have nothing stored
+		err := a.Remove(entry.Server)
+		if err != nil && !errors.Is(err, errAuthNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns the servers with credentials sorted by name. secrets are left
+// out
+func (a *AuthHelper) List() ([]AuthEntry, error) {
+	cfg, err := a.read()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AuthEntry{}
+	for server, raw := range cfg {
+		if !isRconEntry(raw) {
+			continue
+		}
+
+		var c creds
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return nil, err
+		}
+		entries = append(entries, AuthEntry{Server: server, Username: c.Username})
+	}
+
+	if isDockerConfig(cfg) {
+		dockerCfg, err := parseDockerConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dockerCfg.list()...)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Server < entries[j].Server
+	})
+
+	return entries, nil
+}
+
+// delete the rcon entries for any spelling of server, such as https://ghcr.io/
+// for ghcr.io. returns whether there were any
+func removeRconEntries(cfg map[string]json.RawMessage, server string) bool {
+	found := false
+	for key, raw := range cfg {
+		if isRconEntry(raw) && sameServer(key, server) {
+			delete(cfg, key)
+			found = true
+		}
+	}
+
+	return found
+}
+
+// entries in rcon's format, as opposed to docker's sections or other settings
+// in a docker config
+func isRconEntry(raw json.RawMessage) bool {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return false
+	}
+
+	_, ok := fields["secret"]
+	return ok
+}
+
+// Encrypt converts the auth file to the encrypted format, see SetAuthKeyFile.
+// a missing file is created empty
+func (a *AuthHelper) Encrypt() error {
+	data, err := a.readRaw()
+	if err != nil {
+		return err
+	}
+
+	if parseSealedAuth(data) != nil {
+		return fmt.Errorf("%s is already encrypted", a.AuthFile)
+	}
+
+	sealed, err := newSealedAuth()
+	if err != nil {
+		return err
+	}
+
+	data, err = sealed.seal(data)
+	if err != nil {
+		return err
+	}
+
+	return a.replace(data)
+}
+
+// Decrypt converts an encrypted auth file back to plaintext
+func (a *AuthHelper) Decrypt() error {
+	data, err := a.readRaw()
+	if err != nil {
+		return err
+	}
+
+	sealed := parseSealedAuth(data)
+	if sealed == nil {
+		return fmt.Errorf("%s is not encrypted", a.AuthFile)
+	}
+
+	data, err = sealed.open()
+	if err != nil {
+		return err
+	}
+
+	return a.replace(data)
+}
+
+// the settings in the auth file, decrypted if it is encrypted
+func (a *AuthHelper) read() (map[string]json.RawMessage, error) {
+	data, err := a.readRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	if sealed := parseSealedAuth(data); sealed != nil {
+		data, err = sealed.open()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg := make(map[string]json.RawMessage)
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// the contents of the auth file, an empty object if it does not exist
+func (a *AuthHelper) readRaw() ([]byte, error) {
+	if a.AuthFile == "" {
+		return nil, errNoAuthFile
+	}
+
+	if !utils.PathExists(a.AuthFile) {
+		return []byte("{}"), nil
+	}
+
+	return ioutil.ReadFile(a.AuthFile)
+}
+
+// the file is replaced atomically and only readable by its owner, as it holds
+// secrets. a symlinked auth file is replaced at its target
+func (a *AuthHelper) write(cfg map[string]json.RawMessage) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	return a.writeFile(data)
+}
+
+func (a *AuthHelper) writeDocker(cfg map[string]json.RawMessage, dockerCfg *dockerConfig) error {
+	if dockerCfg.Auths != nil {
+		auths, err := json.Marshal(dockerCfg.Auths)
 		if err != nil {
 			return err
 		}
+		cfg[dockerAuthsKey] = auths
 	}
 
-	mapCfg[serverUrl] = creds{Username: username, Secret: secret}
-	data, err := json.Marshal(mapCfg)
+	// indented like docker writes its config
+	data, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return a.writeFile(data)
+}
+
+// encrypted files stay encrypted with the same key
+func (a *AuthHelper) writeFile(data []byte) error {
+	existing, err := a.readRaw()
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(a.AuthFile, data, 0600)
+	if sealed := parseSealedAuth(existing); sealed != nil {
+		data, err = sealed.seal(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.replace(data)
+}
+
+func (a *AuthHelper) replace(data []byte) error {
+	path := a.AuthFile
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+
+	return utils.WriteFileAtomic(path, data, 0600)
 }
@@ -0,0 +1,116 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// the registry the layers of an image were pulled from. partially downloaded
+// layers are resumed from it with range requests, which the layers returned by
+// crane do not support
+type blobSource struct {
+	imageRef string
+	authFile string
+
+	// set up on first use, as most fetches never resume a layer. layers are
+	// downloaded concurrently
+	mu     sync.Mutex
+	repo   name.Repository
+	client *http.Client
+}
+
+func newBlobSource(imageRef, authFile string) *blobSource {
+	return &blobSource{imageRef: imageRef, authFile: authFile}
+}
+
+func (s *blobSource) connect(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return nil
+	}
+
+	cfg, err := loadRegistries()
+	if err != nil {
+		return err
+	}
+
+	regCfg, err := lookupRegistry(cfg, s.imageRef)
+	if err != nil {
+		return err
+	}
+
+	nameOpts := []name.Option{}
+	if regCfg.Insecure {
+		nameOpts = append(nameOpts, name.Insecure)
+	}
+
+	ref, err := name.ParseReference(s.imageRef, nameOpts...)
+	if err != nil {
+		return fmt.Errorf("parsing reference %q: %w", s.imageRef, err)
+	}
+
+	auth, err := keychain(s.authFile).Resolve(ref.Context())
+	if err != nil {
+		return err
+	}
+
+	scopes := []string{ref.Context().Scope(transport.PullScope)}
+	rt, err := authTransport(ctx, ref.Context().Registry, regCfg, auth, scopes)
+	if err != nil {
+		return err
+	}
+
+	s.repo = ref.Context()
+	s.client = &http.Client{Transport: rt}
+	return nil
+}
+
+// open the blob for digest from offset onwards. returns the offset the body
+// starts at, which is 0 if the registry ignored the range
+func (s *blobSource) openBlob(ctx context.Context, digest v1.Hash, offset int64) (io.ReadCloser, int64, error) {
+	if err := s.connect(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	u := url.URL{
+		Scheme: s.repo.Registry.Scheme(),
+		Host:   s.repo.RegistryStr(),
+		Path:   fmt.Sprintf("/v2/%s/blobs/%s", s.repo.RepositoryStr(), digest),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, 0, nil
+	case http.StatusPartialContent:
+		contentRange := resp.Header.Get("Content-Range")
+		if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("registry returned range %q for layer %s, expected one from %d", contentRange, digest, offset)
+		}
+		return resp.Body, offset, nil
+	}
+
+	defer resp.Body.Close()
+	return nil, 0, transport.CheckError(resp, http.StatusOK, http.StatusPartialContent)
+}
@@ -0,0 +1,126 @@
+package container
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CachedImage describes a ref stored in the image cache
+type CachedImage struct {
+	Ref     string    `json:"ref"`
+	Digest  string    `json:"digest"`
+	Size    int64     `json:"size"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// ListImages returns the refs in the cache sorted by name. each ref is a
+// symlink named after the base64 encoded ref pointing to the config digest dir
+func ListImages(cacheDir string) ([]CachedImage, error) {
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []CachedImage{}
+	for _, e := range entries {
+		if e.Type()&fs.ModeSymlink == 0 {
+			continue
+		}
+
+		ref, err := base64.StdEncoding.DecodeString(e.Name())
+		if err != nil {
+			logger.Tracef("Skipping %s: not an image ref", e.Name())
+			continue
+		}
+
+		img, err := describeImage(cacheDir, string(ref))
+		if err != nil {
+			logger.Warnf("Skipping %s: %v", ref, err)
+			continue
+		}
+
+		images = append(images, *img)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Ref < images[j].Ref
+	})
+
+	return images, nil
+}
+
+func describeImage(cacheDir, imageRef string) (*CachedImage, error) {
+	imageFolderLink := getImageDir(cacheDir, imageRef)
+
+	// the symlink is (re)created whenever the ref is fetched
+	linkInfo, err := os.Lstat(imageFolderLink)
+	if err != nil {
+		return nil, err
+	}
+
+	imgDir, err := filepath.EvalSymlinks(imageFolderLink)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := dirSize(imgDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// shared layers are counted for every image using them
+	img, err := loadCachedImage(cacheDir, imgDir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, desc := range manifest.Layers {
+		layerSize, err := dirSize(getLayerDir(cacheDir, desc.Digest))
+		if err != nil {
+			return nil, err
+		}
+		size += layerSize
+	}
+
+	return &CachedImage{
+		Ref:     imageRef,
+		Digest:  filepath.Base(imgDir),
+		Size:    size,
+		Fetched: linkInfo.ModTime(),
+	}, nil
+}
+
+// total size of the regular files under dir. dirs extracted from images that
+// cannot be read are skipped
+func dirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrPermission) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
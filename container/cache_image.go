@@ -0,0 +1,88 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// cachedImage exposes an image in the cache (config.json and manifest.json in
+// the image dir plus blobs from the layer store) as a v1.Image
+type cachedImage struct {
+	imgDir      string
+	cacheDir    string
+	rawManifest []byte
+	manifest    *v1.Manifest
+}
+
+type cachedLayer struct {
+	blobFile string
+	desc     v1.Descriptor
+}
+
+func loadCachedImage(cacheDir, imgDir string) (v1.Image, error) {
+	rawManifest, err := os.ReadFile(filepath.Join(imgDir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &v1.Manifest{}
+	err = json.Unmarshal(rawManifest, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return partial.CompressedToImage(&cachedImage{
+		imgDir:      imgDir,
+		cacheDir:    cacheDir,
+		rawManifest: rawManifest,
+		manifest:    manifest,
+	})
+}
+
+func (i *cachedImage) RawConfigFile() ([]byte, error) {
+	return os.ReadFile(filepath.Join(i.imgDir, "config.json"))
+}
+
+func (i *cachedImage) MediaType() (types.MediaType, error) {
+	if i.manifest.MediaType == "" {
+		return types.OCIManifestSchema1, nil
+	}
+	return i.manifest.MediaType, nil
+}
+
+func (i *cachedImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *cachedImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, desc := range i.manifest.Layers {
+		if desc.Digest == h {
+			return &cachedLayer{blobFile: getLayerBlob(i.cacheDir, h), desc: desc}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("layer %s not found in image", h)
+}
+
+func (l *cachedLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(l.blobFile)
+}
+
+func (l *cachedLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *cachedLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
@@ -0,0 +1,118 @@
+package container
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// CacheIssue is an inconsistency found in the cache
+type CacheIssue struct {
+	Path     string
+	Problem  string
+	Repaired bool
+}
+
+// CheckCache looks for refs pointing to missing or incomplete image dirs,
+// images missing layers, and records of containers which are no longer
+// running. with repair set, dangling refs and stale run records are removed,
+// and refs to images missing layers are removed so they are fetched again
+func CheckCache(cacheDir string, repair bool) ([]CacheIssue, error) {
+	lockFn := rlockCache
+	if repair {
+		lockFn = lockCache
+	}
+	lock, err := lockFn(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	files, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	issues := []CacheIssue{}
+	addIssue := func(path, problem string, fix func() error) error {
+		issue := CacheIssue{Path: path, Problem: problem}
+		if repair {
+			if err := fix(); err != nil {
+				return fmt.Errorf("repair %s: %w", path, err)
+			}
+			issue.Repaired = true
+		}
+		issues = append(issues, issue)
+		return nil
+	}
+
+	for _, f := range files {
+		path := filepath.Join(cacheDir, f.Name())
+		removePath := func() error { return os.Remove(path) }
+
+		if f.Type()&fs.ModeSymlink != 0 {
+			ref, err := base64.StdEncoding.DecodeString(f.Name())
+			if err != nil {
+				continue
+			}
+
+			problem := ""
+			if !utils.PathExists(path) {
+				problem = fmt.Sprintf("ref %s points to a missing image", ref)
+			} else if !utils.PathExists(filepath.Join(path, "manifest.json")) {
+				problem = fmt.Sprintf("ref %s points to an incomplete image", ref)
+			} else if missing, err := missingLayers(cacheDir, path); err != nil {
+				problem = fmt.Sprintf("ref %s points to an unreadable image: %v", ref, err)
+			} else if len(missing) > 0 {
+				problem = fmt.Sprintf("ref %s is missing layer %s", ref, missing[0])
+			}
+
+			if problem != "" {
+				if err := addIssue(path, problem, removePath); err != nil {
+					return issues, err
+				}
+			}
+			continue
+		}
+
+		if !f.IsDir() || f.Name() == layersDirName {
+			continue
+		}
+
+		_, stale, err := listRuns(path)
+		if err != nil {
+			return issues, err
+		}
+
+		for _, id := range stale {
+			marker := filepath.Join(path, runsDirName, id)
+			problem := fmt.Sprintf("container %s is no longer running", id)
+			if err := addIssue(marker, problem, func() error { return os.Remove(marker) }); err != nil {
+				return issues, err
+			}
+		}
+	}
+
+	return issues, nil
+}
+
+// layers in an image's manifest without a blob in the layer store
+func missingLayers(cacheDir, imgDir string) ([]string, error) {
+	manifest, err := readCachedManifest(cacheDir, imgDir)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	for _, desc := range manifest.Layers {
+		if !utils.PathExists(getLayerBlob(cacheDir, desc.Digest)) {
+			missing = append(missing, desc.Digest.String())
+		}
+	}
+
+	return missing, nil
+}
@@ -1,11 +1,13 @@
 package container
 
 import (
+	"context"
 	"encoding/base64"
-	"encoding/json"
-	"io/fs"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
@@ -16,30 +18,127 @@ import (
 
 func FetchContainer(imageRef, cacheDir, authFile string, skipCache bool) error {
 	imageFolderLink := getImageDir(cacheDir, imageRef)
-	if !skipCache && utils.PathExists(imageFolderLink) {
+	cached := utils.PathExists(filepath.Join(imageFolderLink, "manifest.json"))
+	if offline && cached && skipCache {
+		logger.Warnf("Using cached %s since offline mode is enabled", imageRef)
+	}
+
+	if cached && (!skipCache || offline) {
 		logger.Tracef("Skip fetch of container %s", imageRef)
+		touchImage(imageFolderLink)
 		return nil
 	}
 
-	logger.Infof("Fetching container %s", imageRef)
+	// images in local files can still be loaded while offline
+	if offline && !isArchiveRef(imageRef) {
+		return resolveOffline(imageRef, cacheDir)
+	}
+
+	replaced, err := fetchImage(imageRef, cacheDir, authFile)
+	if err != nil {
+		return err
+	}
 
-	// load auth file if provided
-	kc := authn.NewMultiKeychain(
-		authn.NewKeychainFromHelper(&AuthHelper{AuthFile: authFile}),
-		authn.DefaultKeychain,
-	)
+	if replaced {
+		return removeUnusedImages(cacheDir)
+	}
 
-	opts := []crane.Option{crane.WithAuthFromKeychain(kc)}
+	return nil
+}
 
-	// download image manifest
-	img, err := crane.Pull(imageRef, opts...)
+// remove images no longer pointed to after a ref was replaced
+func removeUnusedImages(cacheDir string) error {
+	logger.Info("Removing old image if unused")
+	lock, err := lockCache(cacheDir)
 	if err != nil {
 		return err
 	}
+	defer lock.Unlock()
+
+	if _, err := collectGarbage(cacheDir, utils.RemoveAll); err != nil {
+		logger.Warnf("Failed to clean up cache: %v", err)
+	}
+
+	return nil
+}
 
+// download imageRef into the cache and point its ref at it. returns whether
+// the ref previously pointed to a different image
+func fetchImage(imageRef, cacheDir, authFile string) (bool, error) {
+	lock, err := rlockCache(cacheDir)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Unlock()
+
+	ctx, cancel := fetchContext()
+	defer cancel()
+
+	replaced, err := fetchImageContext(ctx, imageRef, cacheDir, authFile)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return false, fmt.Errorf("fetching %s timed out after %s: %w", imageRef, fetchTimeout, err)
+	}
+
+	return replaced, err
+}
+
+func fetchImageContext(ctx context.Context, imageRef, cacheDir, authFile string) (bool, error) {
+	logger.Infof("Fetching container %s", imageRef)
+
+	// refs for a specific platform are pulled from the image index
+	pullRef, platform, err := splitPlatformRef(imageRef)
+	if err != nil {
+		return false, err
+	}
+
+	// download image manifest
+	var img v1.Image
+	var index *indexSource
+	var src *blobSource
+	if isArchiveRef(pullRef) {
+		img, index, err = loadArchiveImage(pullRef, platform)
+	} else {
+		// registries may be reached through their mirrors
+		err = withMirrors(pullRef, authFile, func(ref string, opts []crane.Option) error {
+			opts = append(opts, crane.WithContext(ctx))
+			err := withRetries(ctx, ref, func() error {
+				var err error
+				img, index, err = pullImage(ref, platform, opts...)
+				return err
+			})
+			if err == nil {
+				src = newBlobSource(ref, authFile)
+			}
+			return err
+		})
+	}
+	if err != nil {
+		return false, err
+	}
+
+	manifestDigest, err := img.Digest()
+	if err != nil {
+		return false, err
+	}
+	logger.Infof("Resolved %s to manifest %s", pullRef, manifestDigest)
+
+	return storeImage(ctx, img, index, imageRef, cacheDir, src)
+}
+
+// store img in the cache and point the ref for imageRef at it. returns whether
+// the ref previously pointed to a different image. must be called with the
+// cache lock held. index is the image index img was selected from, if any. layers are resumed from src if not nil
+func storeImage(ctx context.Context, img v1.Image, index *indexSource, imageRef, cacheDir string, src *blobSource) (bool, error) {
+	progress.startImage(imageRef)
+	replaced, err := storeImageFiles(ctx, img, index, imageRef, cacheDir, src)
+	progress.finishImage(err)
+	return replaced, err
+}
+
+func storeImageFiles(ctx context.Context, img v1.Image, index *indexSource, imageRef, cacheDir string, src *blobSource) (bool, error) {
 	imgHash, err := img.ConfigName()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	imgId := imgHash.String()
@@ -49,114 +148,233 @@ func FetchContainer(imageRef, cacheDir, authFile string, skipCache bool) error {
 	exportDir := filepath.Join(cacheDir, imgId)
 
 	os.MkdirAll(exportDir, 0755)
-	tarFile := filepath.Join(exportDir, "fs.tar")
-	if !utils.PathExists(tarFile) {
-		logger.Info("Exporting filesystem as tar")
-		f, err := os.Create(tarFile)
-		if err != nil {
-			return err
-		}
 
-		err = crane.Export(img, f)
-		if err != nil {
-			f.Close()
-			return err
-		}
-
-		f.Close()
+	// download layers into the shared layer store
+	err = fetchLayers(ctx, img, cacheDir, src)
+	if err != nil {
+		return false, err
 	}
 
-	// extract config
+	// older versions of the cache stored the flattened filesystem
+	_ = os.Remove(filepath.Join(exportDir, "fs.tar"))
+
+	// extract config. files are written atomically so that concurrent fetches
+	// of the same image never see them partially written
 	configFilePath := filepath.Join(exportDir, "config.json")
 	if !utils.PathExists(configFilePath) {
 		logger.Info("Exporting config file")
 		data, err := img.RawConfigFile()
 		if err != nil {
-			return err
+			return false, err
 		}
 
-		err = os.WriteFile(configFilePath, data, fs.ModePerm)
+		err = utils.WriteFileAtomic(configFilePath, data, 0644)
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
 
-	if utils.PathExists(imageFolderLink) {
-		// extract old symlink target. we should remove it and delete the old files
-		oldPath, err := filepath.EvalSymlinks(imageFolderLink)
+	// the manifest is written last as it marks the cache entry as complete
+	manifestFilePath := filepath.Join(exportDir, "manifest.json")
+	if !utils.PathExists(manifestFilePath) {
+		logger.Info("Exporting manifest")
+		data, err := img.RawManifest()
 		if err != nil {
-			return err
+			return false, err
 		}
 
-		// if the symlink is the same as exportDir we can skip
-		if oldPath == exportDir {
-			logger.Info("Skipping as it already exists")
-			return nil
+		err = utils.WriteFileAtomic(manifestFilePath, data, 0644)
+		if err != nil {
+			return false, err
 		}
+	}
 
-		err = os.Remove(imageFolderLink)
-		if err != nil {
-			return err
+	// digest pinned refs may name the index rather than the image, which
+	// offline mode needs to find the image by
+	if index != nil {
+		if err := recordIndex(exportDir, index); err != nil {
+			return false, err
 		}
+	}
+
+	touchImage(exportDir)
+
+	return linkImage(cacheDir, imageRef, exportDir)
+}
 
-		logger.Infof("Removing old image at %s", oldPath)
-		err = os.RemoveAll(oldPath)
+// point the ref for imageRef at the image dir exportDir. returns whether the
+// ref previously pointed to a different image
+func linkImage(cacheDir, imageRef, exportDir string) (bool, error) {
+	imageFolderLink := getImageDir(cacheDir, imageRef)
+
+	replaced := false
+	if _, err := os.Lstat(imageFolderLink); err == nil {
+		// extract old symlink target. the old files are removed later if no other ref uses them
+		oldPath, err := os.Readlink(imageFolderLink)
 		if err != nil {
-			return err
+			return false, err
 		}
+
+		// if the symlink is the same as exportDir we can skip
+		if filepath.Base(oldPath) == filepath.Base(exportDir) {
+			logger.Info("Skipping as it already exists")
+			return false, nil
+		}
+		replaced = true
 	}
 
-	// symlink imageRef -> imgId
+	// symlink imageRef -> imgId, replacing the old link atomically so
+	// concurrent runs of the ref always find an image
 	// convert exportDir to relative path (do we care?)
 	relExportDir, err := filepath.Rel(filepath.Dir(imageFolderLink), exportDir)
 	if err == nil {
-		return os.Symlink(relExportDir, imageFolderLink)
+		err = utils.ReplaceSymlink(relExportDir, imageFolderLink)
 	} else {
 		logger.Warnf("failed to convert %s to relative path with basepath %s", exportDir, imageFolderLink)
-		return os.Symlink(exportDir, imageFolderLink)
+		err = utils.ReplaceSymlink(exportDir, imageFolderLink)
 	}
+	if err != nil {
+		return false, err
+	}
+
+	return replaced, nil
 }
 
-func PrepContainer(imageRef, cacheDir, rootFS string) (string, *v1.Config, error) {
+const (
+	// extract all layers into a tmpfs on every run
+	RootFSTmpfs = "tmpfs"
+	// mount the layers extracted in the cache with overlayfs, with writes going to a tmpfs
+	RootFSOverlay = "overlay"
+	// extract all layers into an existing directory on disk
+	RootFSDir = "dir"
+)
+
+// PrepContainer sets up the rootfs for imageRef at rootFS. tmpfsSize overrides
+// the size of the tmpfs used by the tmpfs and overlay modes if non zero
+func PrepContainer(imageRef, cacheDir, rootFS, rootFSMode string, tmpfsSize int64) (string, *v1.Config, error) {
 	logger.Tracef("Running prep container for %s", imageRef)
 
 	imgDir := getImageDir(cacheDir, imageRef)
-	tarFile := filepath.Join(imgDir, "fs.tar")
+	img, err := loadCachedImage(cacheDir, imgDir)
+	if err != nil {
+		return "", nil, err
+	}
+	touchImage(imgDir)
 
 	// extract filesystem
 	os.MkdirAll(rootFS, 0755)
 
-	// get tar file size
-	tarSize, err := utils.FileSize(tarFile)
+	// get compressed size of the layers
+	manifest, err := img.Manifest()
 	if err != nil {
 		return "", nil, err
 	}
 
-	// create tmpfs which is roughly 10x tarsize
-	err = MountTmpfs(rootFS, tarSize*10, true)
-	if err != nil {
-		return "", nil, err
+	layersSize := int64(0)
+	for _, desc := range manifest.Layers {
+		layersSize += desc.Size
+	}
+
+	// size tmpfs to roughly 10x the uncompressed size, assuming layers
+	// compress to about a third
+	if tmpfsSize <= 0 {
+		tmpfsSize = layersSize * 30
 	}
 
-	err = utils.Untar(tarFile, rootFS)
+	switch rootFSMode {
+	case RootFSOverlay:
+		err = prepOverlay(img, cacheDir, rootFS, tmpfsSize)
+		if err == nil {
+			break
+		}
+		logger.Warnf("Cannot use overlay for rootfs, falling back to tmpfs: %v", err)
+		fallthrough
+	case RootFSTmpfs:
+		err = prepTmpfs(img, rootFS, tmpfsSize)
+	case RootFSDir:
+		err = prepDir(img, rootFS)
+	default:
+		err = fmt.Errorf("unknown rootfs mode %s", rootFSMode)
+	}
 	if err != nil {
 		return "", nil, err
 	}
 
 	// load config
-	cfgFilePath := filepath.Join(imgDir, "config.json")
-	data, err := os.ReadFile(cfgFilePath)
+	cfgFile, err := img.ConfigFile()
 	if err != nil {
 		return "", nil, err
 	}
 
-	cfgFile := v1.ConfigFile{}
-	err = json.Unmarshal(data, &cfgFile)
+	return rootFS, &cfgFile.Config, nil
+}
+
+func prepTmpfs(img v1.Image, rootFS string, size int64) error {
+	err := MountTmpfs(rootFS, size, true)
 	if err != nil {
-		return "", nil, err
+		return err
 	}
 
-	return rootFS, &cfgFile.Config, nil
+	return applyLayers(img, rootFS)
+}
+
+func prepDir(img v1.Image, rootFS string) error {
+	// bind mount rootFS to itself since pivot_root requires a mount point
+	err := MountBind(rootFS, rootFS)
+	if err != nil {
+		return err
+	}
+
+	return applyLayers(img, rootFS)
+}
+
+// the upper and work dirs live in a tmpfs mounted at rootFS, which the overlay
+// is then mounted on top of
+func prepOverlay(img v1.Image, cacheDir, rootFS string, size int64) error {
+	lowerDirs, err := extractLayers(img, cacheDir)
+	if err != nil {
+		return err
+	}
+
+	err = MountTmpfs(rootFS, size, true)
+	if err != nil {
+		return err
+	}
+
+	upperDir := filepath.Join(rootFS, "upper")
+	workDir := filepath.Join(rootFS, "work")
+	err = os.MkdirAll(upperDir, 0755)
+	if err == nil {
+		err = os.MkdirAll(workDir, 0755)
+	}
+	if err == nil {
+		err = MountOverlay(lowerDirs, upperDir, workDir, rootFS)
+	}
+	if err != nil {
+		_ = syscall.Unmount(rootFS, 0)
+		return err
+	}
+
+	return nil
+}
+
+// the credentials for a registry are taken from the first of these with any
+// for it
+//  1. the environment, see RegistryUserEnv
+//  2. authFile
+//  3. podman's auth file, see podmanAuthFiles
+//  4. docker's config, ~/.docker/config.json or $DOCKER_CONFIG/config.json
+func keychain(authFile string) authn.Keychain {
+	keychains := []authn.Keychain{
+		envAuthHelper{},
+		&AuthHelper{AuthFile: authFile},
+	}
+	for _, path := range podmanAuthFiles() {
+		keychains = append(keychains, &AuthHelper{AuthFile: path})
+	}
+	keychains = append(keychains, authn.DefaultKeychain)
+
+	return authn.NewMultiKeychain(keychains...)
 }
 
 func getImageDir(cacheDir, imageRef string) string {
@@ -0,0 +1,329 @@
+package container
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// the sections of docker's config.json holding credentials. podman's auth.json
+// uses the same format
+const (
+	dockerAuthsKey       = "auths"
+	dockerCredHelpersKey = "credHelpers"
+	dockerCredsStoreKey  = "credsStore"
+)
+
+// docker keeps the credentials for docker hub under its v1 url
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// the username helpers and auth files use for identity tokens
+const tokenUsername = "<token>"
+
+type dockerAuth struct {
+	// base64 of username:password
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths,omitempty"`
+	CredHelpers map[string]string     `json:"credHelpers,omitempty"`
+	CredsStore  string                `json:"credsStore,omitempty"`
+}
+
+// whether an auth file holds any of docker's sections
+func isDockerConfig(cfg map[string]json.RawMessage) bool {
+	for _, key := range []string{dockerAuthsKey, dockerCredHelpersKey, dockerCredsStoreKey} {
+		if _, ok := cfg[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDockerConfig(cfg map[string]json.RawMessage) (*dockerConfig, error) {
+	dockerCfg := &dockerConfig{}
+	for key, dest := range map[string]interface{}{
+		dockerAuthsKey:       &dockerCfg.Auths,
+		dockerCredHelpersKey: &dockerCfg.CredHelpers,
+		dockerCredsStoreKey:  &dockerCfg.CredsStore,
+	} {
+		data, ok := cfg[key]
+		if !ok {
+			continue
+		}
+
+		if err := json.Unmarshal(data, dest); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", key, err)
+		}
+	}
+
+	return dockerCfg, nil
+}
+
+// the servers with entries in credHelpers or auths
+func (c *dockerConfig) servers() []string {
+	servers := []string{}
+	for key := range c.CredHelpers {
+		servers = append(servers, key)
+	}
+	for key := range c.Auths {
+		servers = append(servers, key)
+	}
+	return servers
+}
+
+// the credentials for target, a registry or repository, given the server
+// applying to it if found, see matchServer. they are looked up with the
+// credential helper for the server in credHelpers, or else the credential
+// store named by credsStore and then its entry in auths. registries without
+// entries are looked up in the credential store as well
+func (c *dockerConfig) get(target, server string, found bool) (string, string, error) {
+	helperServers := []string{}
+	for key := range c.CredHelpers {
+		helperServers = append(helperServers, key)
+	}
+	authServers := []string{}
+	for key := range c.Auths {
+		authServers = append(authServers, key)
+	}
+
+	// credHelpers take precedence over auths for the same server
+	if helperKey, ok := findServer(helperServers, server); found && ok {
+		return helperGet(c.CredHelpers[helperKey], helperKey)
+	}
+
+	key, ok := findServer(authServers, server)
+	found = found && ok
+
+	if c.CredsStore != "" {
+		storeKey := dockerAuthKey(registryHost(target))
+		if found {
+			storeKey = key
+		}
+
+		// docker falls back to auths when the store cannot be used, e.g. when
+		// its helper is not installed
+		user, secret, err := helperGet(c.CredsStore, storeKey)
+		if err == nil {
+			return user, secret, nil
+		}
+		if err != errAuthNotFound {
+			logger.Warnf("Failed to read credentials for %s: %v", storeKey, err)
+		}
+	}
+
+	if !found {
+		return "", "", errAuthNotFound
+	}
+
+	auth := c.Auths[key]
+	switch {
+	case auth.IdentityToken != "":
+		return tokenUsername, auth.IdentityToken, nil
+	case auth.Auth != "":
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid auth for %s: %w", key, err)
+		}
+
+		user, secret, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return "", "", fmt.Errorf("invalid auth for %s, expected username:password", key)
+		}
+		return user, secret, nil
+	case auth.Username != "":
+		return auth.Username, auth.Password, nil
+	}
+
+	return "", "", errAuthNotFound
+}
+
+// store credentials for server with its credential helper if it has one, or
+// in auths otherwise
+func (c *dockerConfig) add(server, username, secret string) error {
+	key := dockerAuthKey(server)
+	if helperKey, helper, ok := c.credHelper(server); ok {
+		return helperStore(helper, helperKey, username, secret)
+	}
+
+	if c.Auths == nil {
+		c.Auths = map[string]dockerAuth{}
+	}
+
+	// entries for the same server under another spelling would shadow this one
+	for k := range c.Auths {
+		if sameServer(k, server) {
+			delete(c.Auths, k)
+		}
+	}
+
+	if c.CredsStore != "" {
+		// docker records servers with credentials in the store in auths
+		c.Auths[key] = dockerAuth{}
+		return helperStore(c.CredsStore, key, username, secret)
+	}
+
+	if username == tokenUsername {
+		c.Auths[key] = dockerAuth{IdentityToken: secret}
+	} else {
+		c.Auths[key] = dockerAuth{Auth: base64.StdEncoding.EncodeToString([]byte(username + ":" + secret))}
+	}
+	return nil
+}
+
+// delete the credentials for server from auths and its credential helper.
+// returns whether there were any
+func (c *dockerConfig) remove(server string) (bool, error) {
+	if key, helper, ok := c.credHelper(server); ok {
+		return helperErase(helper, key)
+	}
+
+	found := false
+	for key := range c.Auths {
+		if !sameServer(key, server) {
+			continue
+		}
+		found = true
+		delete(c.Auths, key)
+
+		if c.CredsStore != "" {
+			if _, err := helperErase(c.CredsStore, key); err != nil {
+				return found, err
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// the servers in auths and credHelpers. usernames are looked up in the
+// credential helpers holding them
+func (c *dockerConfig) list() []AuthEntry {
+	entries := []AuthEntry{}
+	for key, auth := range c.Auths {
+		if _, _, ok := c.credHelper(key); ok {
+			continue
+		}
+
+		entry := AuthEntry{Server: key, Username: auth.Username}
+		switch {
+		case auth.IdentityToken != "":
+			entry.Username = tokenUsername
+		case auth.Auth != "":
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err == nil {
+				entry.Username, _, _ = strings.Cut(string(decoded), ":")
+			}
+		case auth.Username == "" && c.CredsStore != "":
+			entry.Helper = c.CredsStore
+			entry.Username = helperUsername(c.CredsStore, key)
+		}
+		entries = append(entries, entry)
+	}
+
+	// servers in credHelpers are only listed if the helper has credentials
+	for key, helper := range c.CredHelpers {
+		if username := helperUsername(helper, key); username != "" {
+			entries = append(entries, AuthEntry{Server: key, Username: username, Helper: helper})
+		}
+	}
+
+	return entries
+}
+
+// the credential helper named for server in credHelpers and the key it was
+// named under. servers under its path have their own entries
+func (c *dockerConfig) credHelper(server string) (string, string, bool) {
+	for key, helper := range c.CredHelpers {
+		if sameServer(key, server) {
+			return key, helper, true
+		}
+	}
+	return "", "", false
+}
+
+// the key docker uses for a server in auths and credential stores
+func dockerAuthKey(server string) string {
+	if normalizeServer(server) == name.DefaultRegistry {
+		return dockerHubAuthKey
+	}
+	return server
+}
+
+// run docker-credential-<helper> get for serverURL
+func helperGet(helper, serverURL string) (string, string, error) {
+	creds, err := client.Get(client.NewShellProgramFunc("docker-credential-"+helper), serverURL)
+	if credentials.IsErrCredentialsNotFound(err) {
+		return "", "", errAuthNotFound
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("docker-credential-%s: %w", helper, err)
+	}
+
+	return creds.Username, creds.Secret, nil
+}
+
+// run docker-credential-<helper> store for serverURL
+func helperStore(helper, serverURL, username, secret string) error {
+	creds := &credentials.Credentials{ServerURL: serverURL, Username: username, Secret: secret}
+	err := client.Store(client.NewShellProgramFunc("docker-credential-"+helper), creds)
+	if err != nil {
+		return fmt.Errorf("docker-credential-%s: %w", helper, err)
+	}
+
+	return nil
+}
+
+// run docker-credential-<helper> erase for serverURL. returns whether the
+// helper had credentials for it
+func helperErase(helper, serverURL string) (bool, error) {
+	program := client.NewShellProgramFunc("docker-credential-" + helper)
+	if _, err := client.Get(program, serverURL); credentials.IsErrCredentialsNotFound(err) {
+		return false, nil
+	}
+
+	if err := client.Erase(program, serverURL); err != nil {
+		return false, fmt.Errorf("docker-credential-%s: %w", helper, err)
+	}
+
+	return true, nil
+}
+
+// the username the helper holds for serverURL, empty if it cannot be read
+func helperUsername(helper, serverURL string) string {
+	username, _, err := helperGet(helper, serverURL)
+	if err != nil && err != errAuthNotFound {
+		logger.Warnf("Failed to read credentials for %s: %v", serverURL, err)
+	}
+
+	return username
+}
+
+// the auth files podman reads: $REGISTRY_AUTH_FILE if set, otherwise
+// $XDG_RUNTIME_DIR/containers/auth.json and ~/.config/containers/auth.json
+func podmanAuthFiles() []string {
+	if path := os.Getenv("REGISTRY_AUTH_FILE"); path != "" {
+		return []string{path}
+	}
+
+	files := []string{}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		files = append(files, filepath.Join(dir, "containers", "auth.json"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".config", "containers", "auth.json"))
+	}
+
+	return files
+}
@@ -0,0 +1,56 @@
+package container
+
+import (
+	"os"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// credentials can be given in the environment, e.g. in CI where there is no
+// auth file. they are only used for the server, which may be a registry or a
+// repository path such as ghcr.io/myorg, and are ignored if it is not set so
+// that they are never sent to other registries
+const (
+	RegistryUserEnv   = "RCON_REGISTRY_USER"
+	RegistrySecretEnv = "RCON_REGISTRY_SECRET"
+	RegistryServerEnv = "RCON_REGISTRY_SERVER"
+)
+
+// envAuthHelper is an authn.Keychain returning the credentials in the
+// environment
+type envAuthHelper struct{}
+
+// credentials are looked up for every registry, so only warn once
+var warnEnvServerOnce sync.Once
+
+func (h envAuthHelper) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	return resolveWithHelper(h, target)
+}
+
+func (envAuthHelper) Get(serverURL string) (string, string, error) {
+	secret := os.Getenv(RegistrySecretEnv)
+	if secret == "" {
+		return "", "", errAuthNotFound
+	}
+
+	server := os.Getenv(RegistryServerEnv)
+	if server == "" {
+		warnEnvServerOnce.Do(func() {
+			logger.Warnf("Ignoring %s as %s is not set", RegistrySecretEnv, RegistryServerEnv)
+		})
+		return "", "", errAuthNotFound
+	}
+
+	if !matchesServer(server, serverURL) {
+		return "", "", errAuthNotFound
+	}
+
+	// a secret without a username is a token, as with rcon login
+	username := os.Getenv(RegistryUserEnv)
+	if username == "" {
+		username = tokenUsername
+	}
+
+	return username, secret, nil
+}
@@ -0,0 +1,87 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// transient registry errors are retried with exponential backoff, starting
+// at retryDelay and doubling up to maxRetryDelay
+const (
+	fetchAttempts = 5
+	retryDelay    = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+var (
+	fetchJobs    = 4
+	fetchTimeout time.Duration
+)
+
+// SetFetchJobs sets how many layers of an image are downloaded at once
+func SetFetchJobs(jobs int) {
+	fetchJobs = jobs
+}
+
+// SetFetchTimeout limits the total time spent fetching an image, including
+// retries. zero means no limit
+func SetFetchTimeout(timeout time.Duration) {
+	fetchTimeout = timeout
+}
+
+// the context for fetching an image, which expires after the fetch timeout
+func fetchContext() (context.Context, context.CancelFunc) {
+	if fetchTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), fetchTimeout)
+}
+
+// call fn until it succeeds, fails with an error which is not transient or
+// has been tried fetchAttempts times. what names what is fetched in warnings
+func withRetries(ctx context.Context, what string, fn func() error) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil || attempt == fetchAttempts || !isTransient(err) {
+			return err
+		}
+
+		logger.Warnf("Failed to fetch %s, retrying in %s: %v", what, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// rate limiting, server errors and dropped connections are worth retrying
+func isTransient(err error) bool {
+	var transportErr *transport.Error
+	if errors.As(err, &transportErr) {
+		return transportErr.StatusCode == http.StatusTooManyRequests || transportErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
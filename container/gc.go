@@ -0,0 +1,257 @@
+package container
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Remover deletes a path from the cache. files extracted from images may be
+// owned by subordinate ids, so callers can supply one which handles that
+type Remover func(path string) error
+
+const layersDirName = "layers"
+
+// RemoveImage removes imageRef from the cache. the image dir it points to and
+// any layers only used by it are only deleted once no other ref uses them
+func RemoveImage(cacheDir, imageRef string, remove Remover) error {
+	lock, err := lockCache(cacheDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	imageFolderLink := getImageDir(cacheDir, imageRef)
+	if _, err := os.Lstat(imageFolderLink); os.IsNotExist(err) {
+		return fmt.Errorf("image %s not found in cache", imageRef)
+	}
+
+	logger.Infof("Removing ref %s", imageRef)
+	err = os.Remove(imageFolderLink)
+	if err != nil {
+		return err
+	}
+
+	_, err = collectGarbage(cacheDir, remove)
+	return err
+}
+
+// PruneImages removes image dirs and layers which are no longer referenced.
+// images not used within olderThan, and least recently used images while
+// the cache is larger than maxSize, are removed along with all their refs.
+// zero disables either policy. returns the refs removed and bytes reclaimed
+func PruneImages(cacheDir string, olderThan time.Duration, maxSize int64, remove Remover) ([]string, int64, error) {
+	lock, err := lockCache(cacheDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer lock.Unlock()
+
+	removedRefs := []string{}
+
+	reclaimed, err := collectGarbage(cacheDir, remove)
+	if err != nil {
+		return nil, reclaimed, err
+	}
+
+	entries, err := listImageDirs(cacheDir)
+	if err != nil {
+		return nil, reclaimed, err
+	}
+
+	// least recently used first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+
+	total, err := dirSize(cacheDir)
+	if err != nil {
+		return nil, reclaimed, err
+	}
+
+	for _, entry := range entries {
+		expired := olderThan > 0 && time.Since(entry.lastUsed) > olderThan
+		overSize := maxSize > 0 && total > maxSize
+		if !expired && !overSize {
+			continue
+		}
+
+		if len(entry.runs) > 0 {
+			logger.Infof("Keeping %s, in use by %d running containers", filepath.Base(entry.dir), len(entry.runs))
+			continue
+		}
+
+		for _, ref := range entry.refs {
+			logger.Infof("Removing ref %s", ref)
+			err = os.Remove(getImageDir(cacheDir, ref))
+			if err != nil {
+				return removedRefs, reclaimed, err
+			}
+			removedRefs = append(removedRefs, ref)
+		}
+
+		freed, err := collectGarbage(cacheDir, remove)
+		reclaimed += freed
+		total -= freed
+		if err != nil {
+			return removedRefs, reclaimed, err
+		}
+	}
+
+	return removedRefs, reclaimed, nil
+}
+
+type imageDirEntry struct {
+	dir      string
+	refs     []string
+	runs     []string
+	lastUsed time.Time
+}
+
+// image dirs in the cache along with the refs pointing to each of them and
+// the containers currently running them
+func listImageDirs(cacheDir string) ([]*imageDirEntry, error) {
+	files, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]*imageDirEntry{}
+	for _, f := range files {
+		if !f.IsDir() || f.Name() == layersDirName {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		dir := filepath.Join(cacheDir, f.Name())
+		runs, _, err := listRuns(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		entries[f.Name()] = &imageDirEntry{
+			dir:      dir,
+			runs:     runs,
+			lastUsed: info.ModTime(),
+		}
+	}
+
+	for _, f := range files {
+		if f.Type()&fs.ModeSymlink == 0 {
+			continue
+		}
+
+		ref, err := base64.StdEncoding.DecodeString(f.Name())
+		if err != nil {
+			continue
+		}
+
+		target, err := os.Readlink(filepath.Join(cacheDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if entry, ok := entries[filepath.Base(target)]; ok {
+			entry.refs = append(entry.refs, string(ref))
+		}
+	}
+
+	list := []*imageDirEntry{}
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+
+	return list, nil
+}
+
+// remove image dirs without refs or running containers, followed by layers
+// not used by any remaining image dir. returns the number of bytes freed.
+// must be called with the cache lock held exclusively
+func collectGarbage(cacheDir string, remove Remover) (int64, error) {
+	entries, err := listImageDirs(cacheDir)
+	if err != nil {
+		return 0, err
+	}
+
+	freed := int64(0)
+	usedLayers := map[string]bool{}
+	skipLayers := false
+	for _, entry := range entries {
+		if len(entry.refs) == 0 && len(entry.runs) == 0 {
+			size, _ := dirSize(entry.dir)
+			logger.Infof("Removing unreferenced image %s", filepath.Base(entry.dir))
+			if err := remove(entry.dir); err != nil {
+				return freed, err
+			}
+			freed += size
+			continue
+		}
+
+		// keep all layers if an image can't be read rather than risk removing its layers
+		manifest, err := readCachedManifest(cacheDir, entry.dir)
+		if err != nil {
+			logger.Warnf("Cannot read image %s, skipping layer cleanup: %v", filepath.Base(entry.dir), err)
+			skipLayers = true
+			continue
+		}
+
+		for _, desc := range manifest.Layers {
+			usedLayers[desc.Digest.String()] = true
+		}
+	}
+
+	if skipLayers {
+		return freed, nil
+	}
+
+	layersDir := filepath.Join(cacheDir, layersDirName)
+	layers, err := os.ReadDir(layersDir)
+	if os.IsNotExist(err) {
+		return freed, nil
+	} else if err != nil {
+		return freed, err
+	}
+
+	for _, layer := range layers {
+		if usedLayers[layer.Name()] {
+			continue
+		}
+
+		layerDir := filepath.Join(layersDir, layer.Name())
+		size, _ := dirSize(layerDir)
+		logger.Infof("Removing unreferenced layer %s", layer.Name())
+		if err := remove(layerDir); err != nil {
+			return freed, err
+		}
+		freed += size
+	}
+
+	return freed, nil
+}
+
+func readCachedManifest(cacheDir, imgDir string) (*v1.Manifest, error) {
+	img, err := loadCachedImage(cacheDir, imgDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return img.Manifest()
+}
+
+// record that an image dir was used, for least recently used pruning
+func touchImage(imgDir string) {
+	now := time.Now()
+	if err := os.Chtimes(imgDir, now, now); err != nil {
+		logger.Warnf("Failed to update last use of %s: %v", imgDir, err)
+	}
+}
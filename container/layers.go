@@ -0,0 +1,325 @@
+package container
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// layers are stored once per digest under cacheDir/layers and shared by all
+// images referencing them. the blob is kept exactly as served by the registry,
+// and may be extracted next to it for use with overlayfs. each layer has its
+// own lock so that it is only downloaded and extracted once at a time.
+// downloads in progress are written to the partial file. dirs extracted from a
+// corrupted blob which running containers still use are marked by the invalid
+// file until they can be removed
+const (
+	layerBlobName    = "blob"
+	layerPartialName = "blob.partial"
+	layerDiffName    = "diff"
+	layerInvalidName = "diff.invalid"
+	layerLockName    = "lock"
+)
+
+func getLayerDir(cacheDir string, digest v1.Hash) string {
+	return filepath.Join(cacheDir, "layers", digest.String())
+}
+
+func getLayerBlob(cacheDir string, digest v1.Hash) string {
+	return filepath.Join(getLayerDir(cacheDir, digest), layerBlobName)
+}
+
+func lockLayer(cacheDir string, digest v1.Hash) (*utils.FileLock, error) {
+	layerDir := getLayerDir(cacheDir, digest)
+	err := os.MkdirAll(layerDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.LockFile(filepath.Join(layerDir, layerLockName))
+}
+
+// remove temp files and dirs left behind by a fetch or extraction that was
+// killed. must be called with the layer lock held
+func removeStaleTemps(layerDir string) {
+	temps, _ := filepath.Glob(filepath.Join(layerDir, "*.tmp-*"))
+	for _, tmp := range temps {
+		logger.Tracef("Removing stale %s", tmp)
+		if err := utils.RemoveAll(tmp); err != nil {
+			logger.Warnf("Failed to remove %s: %v", tmp, err)
+		}
+	}
+}
+
+// download any layers of img which are not in the layer store yet, up to
+// fetchJobs at a time. layers of images pulled from a registry are resumed
+// from src if a previous attempt was interrupted, src is nil for images
+// loaded from files
+func fetchLayers(ctx context.Context, img v1.Image, cacheDir string, src *blobSource) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	missing := map[v1.Hash]v1.Layer{}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+
+		size, err := layer.Size()
+		if err != nil {
+			return err
+		}
+
+		// images may contain the same layer more than once
+		if _, ok := missing[digest]; ok {
+			continue
+		}
+
+		cached := utils.PathExists(getLayerBlob(cacheDir, digest))
+		progress.addLayer(digest, size, cached)
+		if !cached {
+			missing[digest] = layer
+		}
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(fetchJobs)
+	for digest, layer := range missing {
+		digest, layer := digest, layer
+		g.Go(func() error {
+			lock, err := lockLayer(cacheDir, digest)
+			if err != nil {
+				return err
+			}
+			defer lock.Unlock()
+
+			err = withRetries(ctx, "layer "+digest.String(), func() error {
+				return fetchLayer(ctx, layer, digest, getLayerBlob(cacheDir, digest), src)
+			})
+			progress.finishLayer(digest, err)
+			return err
+		})
+	}
+
+	return g.Wait()
+}
+
+func fetchLayer(ctx context.Context, layer v1.Layer, digest v1.Hash, blobFile string, src *blobSource) error {
+	// another fetch may have stored the layer while waiting for the lock
+	if utils.PathExists(blobFile) {
+		logger.Tracef("Layer %s already in cache", digest)
+		return nil
+	}
+
+	removeStaleTemps(filepath.Dir(blobFile))
+
+	logger.Infof("Fetching layer %s", digest)
+	return writeLayerBlob(ctx, layer, digest, blobFile, src)
+}
+
+// the blob is downloaded to a partial file which is only renamed into place
+// once complete and matching its digest, so a blob in the cache is never
+// truncated. the partial file is kept if the download fails, and the next
+// fetch resumes from where it stopped
+func writeLayerBlob(ctx context.Context, layer v1.Layer, digest v1.Hash, blobFile string, src *blobSource) error {
+	size, err := layer.Size()
+	if err != nil {
+		return err
+	}
+
+	partialFile := filepath.Join(filepath.Dir(blobFile), layerPartialName)
+	offset := int64(0)
+	if info, err := os.Stat(partialFile); err == nil {
+		offset = info.Size()
+	}
+
+	// layers read from files are cheap to read again
+	if offset > 0 && (src == nil || offset >= size) {
+		offset = 0
+	}
+
+	var rc io.ReadCloser
+	if offset > 0 {
+		rc, offset, err = src.openBlob(ctx, digest, offset)
+		if err != nil {
+			logger.Warnf("Cannot resume layer %s, downloading it again: %v", digest, err)
+			offset = 0
+		} else if offset == 0 {
+			logger.Infof("Registry does not support resuming downloads, downloading layer %s again", digest)
+		}
+	}
+	if rc == nil {
+		rc, err = layer.Compressed()
+		if err != nil {
+			return err
+		}
+	}
+	defer rc.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	}
+
+	f, err := os.OpenFile(partialFile, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	// the digest covers the bytes downloaded by earlier fetches too
+	h := sha256.New()
+	if offset > 0 {
+		_, err = io.Copy(h, io.LimitReader(f, offset))
+	}
+
+	progress.startLayer(digest, offset)
+	n := int64(0)
+	if err == nil {
+		n, err = io.Copy(io.MultiWriter(f, h, layerProgressWriter(digest)), rc)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// keep what was downloaded so far to resume from
+		return err
+	}
+
+	if offset+n != size {
+		err = fmt.Errorf("layer download incomplete, got %d of %d bytes", offset+n, size)
+	} else if digest.Algorithm == "sha256" && hex.EncodeToString(h.Sum(nil)) != digest.Hex {
+		err = fmt.Errorf("layer %s downloaded with wrong digest", digest)
+	}
+	if err == nil {
+		err = os.Rename(partialFile, blobFile)
+	}
+	if err != nil {
+		_ = os.Remove(partialFile)
+		return err
+	}
+
+	return nil
+}
+
+// extract the layers of img in order into rootFS
+func applyLayers(img v1.Image, rootFS string) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+
+		logger.Tracef("Applying layer %s", digest)
+		rc, err := layer.Uncompressed()
+		if err != nil {
+			return err
+		}
+
+		err = utils.ApplyLayer(rc, rootFS)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extract the layers of img into the layer store for use as overlayfs lower
+// dirs. returns the extracted dirs with the topmost layer first
+func extractLayers(img v1.Image, cacheDir string) ([]string, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	lowerDirs := []string{}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+
+		diffDir := filepath.Join(getLayerDir(cacheDir, digest), layerDiffName)
+		lowerDirs = append([]string{diffDir}, lowerDirs...)
+		if utils.PathExists(filepath.Join(getLayerDir(cacheDir, digest), layerInvalidName)) {
+			return nil, fmt.Errorf("layer %s was extracted from a corrupted blob and is still in use, run rcon verify once its containers exit", digest)
+		}
+		if utils.PathExists(diffDir) {
+			logger.Tracef("Layer %s already extracted", digest)
+			continue
+		}
+
+		lock, err := lockLayer(cacheDir, digest)
+		if err != nil {
+			return nil, err
+		}
+
+		// another run may have extracted the layer while waiting for the lock
+		if !utils.PathExists(diffDir) {
+			removeStaleTemps(filepath.Dir(diffDir))
+			logger.Infof("Extracting layer %s", digest)
+			err = extractLayer(layer, diffDir)
+		}
+		lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return lowerDirs, nil
+}
+
+// extract into a temp dir and rename it into place so that a partially
+// extracted layer is never used
+func extractLayer(layer v1.Layer, diffDir string) error {
+	tmpDir, err := os.MkdirTemp(filepath.Dir(diffDir), layerDiffName+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	// the dir becomes the root of the filesystem, MkdirTemp creates it as 0700
+	err = os.Chmod(tmpDir, 0755)
+	if err == nil {
+		err = extractLayerInto(layer, tmpDir)
+	}
+	if err == nil {
+		err = os.Rename(tmpDir, diffDir)
+	}
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return err
+	}
+
+	return nil
+}
+
+func extractLayerInto(layer v1.Layer, dir string) error {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return utils.ExtractOverlayLayer(rc, dir)
+}
@@ -0,0 +1,20 @@
+package container
+
+import (
+	"path/filepath"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// fetches hold the cache lock shared while adding content, while removing
+// content from the cache requires it exclusively so nothing is deleted before
+// a ref points to it
+const cacheLockName = ".lock"
+
+func lockCache(cacheDir string) (*utils.FileLock, error) {
+	return utils.LockFile(filepath.Join(cacheDir, cacheLockName))
+}
+
+func rlockCache(cacheDir string) (*utils.FileLock, error) {
+	return utils.RLockFile(filepath.Join(cacheDir, cacheLockName))
+}
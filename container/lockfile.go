@@ -0,0 +1,90 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// ImageLock pins image refs to the manifest digests they resolved to, so that
+// every machine using the lock file runs identical images
+type ImageLock struct {
+	Images map[string]string `json:"images"`
+}
+
+// LoadImageLock reads the lock file at path. a missing file is an empty lock
+func LoadImageLock(path string) (*ImageLock, error) {
+	lock := &ImageLock{Images: map[string]string{}}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return lock, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, lock)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	if lock.Images == nil {
+		lock.Images = map[string]string{}
+	}
+
+	return lock, nil
+}
+
+// Save writes the lock to path
+func (l *ImageLock) Save(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return utils.WriteFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// Resolve returns the digest ref imageRef is pinned to, or imageRef itself if
+// it is not in the lock
+func (l *ImageLock) Resolve(imageRef string) (string, error) {
+	digest, ok := l.Images[imageRef]
+	if !ok {
+		return imageRef, nil
+	}
+
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return "", err
+	}
+
+	return ref.Context().Name() + "@" + digest, nil
+}
+
+// Update resolves imageRef against its registry and pins it to the digest
+// found. for multi-arch images this is the digest of the index, so the lock
+// is valid for every platform
+func (l *ImageLock) Update(imageRef, authFile string) (string, error) {
+	if offline {
+		return "", errors.New("cannot resolve digests from registries in offline mode")
+	}
+
+	digest := ""
+	err := withMirrors(imageRef, authFile, func(ref string, opts []crane.Option) error {
+		var err error
+		digest, err = crane.Digest(ref, opts...)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	l.Images[imageRef] = digest
+	return digest, nil
+}
@@ -0,0 +1,69 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// ValidateLogin authenticates against the registry of server with the
+// credentials, so that wrong ones are caught before they are saved
+func ValidateLogin(server, username, secret string) error {
+	if offline {
+		return errors.New("cannot validate credentials in offline mode")
+	}
+
+	cfg, err := loadRegistries()
+	if err != nil {
+		return err
+	}
+
+	host := registryHost(server)
+
+	regCfg := cfg.Registries[host]
+	nameOpts := []name.Option{}
+	if regCfg.Insecure {
+		nameOpts = append(nameOpts, name.Insecure)
+	}
+
+	reg, err := name.NewRegistry(host, nameOpts...)
+	if err != nil {
+		return err
+	}
+
+	auth := credsAuthenticator(username, secret)
+
+	// registries using tokens check the credentials when issuing one, others
+	// only once the api is called
+	ctx := context.Background()
+	rt, err := authTransport(ctx, reg, regCfg, auth, nil)
+	if err != nil {
+		return fmt.Errorf("login to %s failed: %w", server, err)
+	}
+
+	u := url.URL{Scheme: reg.Scheme(), Host: reg.RegistryStr(), Path: "/v2/"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return fmt.Errorf("login to %s failed: %w", server, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("login to %s failed: invalid username or secret", server)
+	}
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return fmt.Errorf("login to %s failed: %w", server, err)
+	}
+
+	return nil
+}
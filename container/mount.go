@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/samirkut/rcon/utils"
@@ -82,3 +83,25 @@ func MountTmpfs(path string, size int64, allowExec bool) error {
 
 	return syscall.Mount("tmpfs", path, "tmpfs", flags, options)
 }
+
+func MountOverlay(lowerDirs []string, upperDir, workDir, target string) error {
+	logger.Tracef("Create overlay mount %s, lower: %v, upper: %s", target, lowerDirs, upperDir)
+
+	// ':' separates lower dirs and ',' separates options, so both need escaping.
+	// layer dirs contain ':' as part of the digest
+	escape := strings.NewReplacer(`\`, `\\`, ":", `\:`, ",", `\,`)
+
+	lowers := make([]string, len(lowerDirs))
+	for i, dir := range lowerDirs {
+		lowers[i] = escape.Replace(dir)
+	}
+
+	// userxattr is required inside a user namespace, and makes overlayfs use
+	// the user.overlay.* xattrs set when extracting layers
+	options := "lowerdir=" + strings.Join(lowers, ":") +
+		",upperdir=" + escape.Replace(upperDir) +
+		",workdir=" + escape.Replace(workDir) +
+		",userxattr"
+
+	return syscall.Mount("overlay", target, "overlay", 0, options)
+}
@@ -0,0 +1,140 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// in offline mode images are only ever loaded from the cache
+var offline bool
+
+// SetOffline stops registries from being contacted when enabled. fetching a
+// ref which isn't cached fails instead
+func SetOffline(enabled bool) {
+	offline = enabled
+}
+
+// the image indexes an image dir was selected from are listed in this file,
+// one per line as the digest of the index followed by the platform selected
+const indexesFileName = "indexes"
+
+// an image index along with the platform an image was selected for from it
+type indexSource struct {
+	digest   v1.Hash
+	platform v1.Platform
+}
+
+// resolve a ref which isn't cached without contacting its registry. refs
+// pinned to a digest are found by the digest of the cached manifests, or of
+// the index they were selected from for the platform of the ref
+func resolveOffline(imageRef, cacheDir string) error {
+	notCached := fmt.Errorf("image %s is not in the cache and offline mode is enabled", imageRef)
+
+	ref, platform, err := splitPlatformRef(imageRef)
+	if err != nil {
+		return err
+	}
+	if platform == nil {
+		platform = &defaultPlatform
+	}
+
+	digestRef, err := name.NewDigest(ref)
+	if err != nil {
+		return notCached
+	}
+
+	want, err := v1.NewHash(digestRef.DigestStr())
+	if err != nil {
+		return err
+	}
+
+	lock, err := rlockCache(cacheDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	entries, err := listImageDirs(cacheDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !manifestMatches(entry.dir, want) && !indexMatches(entry.dir, want, platform) {
+			continue
+		}
+
+		logger.Infof("Resolved %s to cached image %s", imageRef, filepath.Base(entry.dir))
+		touchImage(entry.dir)
+		_, err = linkImage(cacheDir, imageRef, entry.dir)
+		return err
+	}
+
+	return notCached
+}
+
+func manifestMatches(imgDir string, want v1.Hash) bool {
+	f, err := os.Open(filepath.Join(imgDir, "manifest.json"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	digest, _, err := v1.SHA256(f)
+	return err == nil && digest == want
+}
+
+// whether the image in imgDir was selected for platform from the index want
+func indexMatches(imgDir string, want v1.Hash, platform *v1.Platform) bool {
+	for _, index := range readIndexes(imgDir) {
+		if index.digest == want && platformMatches(index.platform, platform) {
+			return true
+		}
+	}
+	return false
+}
+
+func readIndexes(imgDir string) []indexSource {
+	data, err := os.ReadFile(filepath.Join(imgDir, indexesFileName))
+	if err != nil {
+		return nil
+	}
+
+	indexes := []indexSource{}
+	for _, line := range strings.Split(string(data), "\n") {
+		digest, platform, _ := strings.Cut(line, " ")
+		h, err := v1.NewHash(digest)
+		if err != nil {
+			continue
+		}
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, indexSource{digest: h, platform: *p})
+	}
+
+	return indexes
+}
+
+// add index to the indexes imgDir was selected from
+func recordIndex(imgDir string, index *indexSource) error {
+	lines := []string{}
+	for _, i := range readIndexes(imgDir) {
+		if i.digest == index.digest && i.platform.String() == index.platform.String() {
+			return nil
+		}
+		lines = append(lines, i.digest.String()+" "+i.platform.String())
+	}
+
+	lines = append(lines, index.digest.String()+" "+index.platform.String())
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	return utils.WriteFileAtomic(filepath.Join(imgDir, indexesFileName), data, 0644)
+}
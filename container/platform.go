@@ -0,0 +1,157 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// refs for a specific platform are cached under the ref followed by the
+// platform, e.g. alpine:3#linux/arm64. the separator cannot appear in registry
+// refs, but may in the path of archive refs, so refs are split at the last one
+// and only if it is followed by a platform
+const platformSeparator = "#"
+
+// the platform used for multi-arch images when none is requested, as for
+// images pulled from registries
+var defaultPlatform = v1.Platform{OS: "linux", Architecture: "amd64"}
+
+// PlatformRef qualifies imageRef with platform (os/arch[/variant]) so that each
+// platform of a multi-arch image is cached separately. refs for the default
+// platform are left unchanged
+func PlatformRef(imageRef, platform string) (string, error) {
+	if platform == "" {
+		return imageRef, nil
+	}
+
+	p, err := parsePlatform(platform)
+	if err != nil {
+		return "", err
+	}
+
+	if p.String() == defaultPlatform.String() {
+		return imageRef, nil
+	}
+
+	return imageRef + platformSeparator + p.String(), nil
+}
+
+// split a ref qualified by PlatformRef. the platform is nil for the default
+func splitPlatformRef(imageRef string) (string, *v1.Platform, error) {
+	i := strings.LastIndex(imageRef, platformSeparator)
+	if i < 0 {
+		return imageRef, nil, nil
+	}
+
+	p, err := parsePlatform(imageRef[i+len(platformSeparator):])
+	if err != nil {
+		if isArchiveRef(imageRef) {
+			return imageRef, nil, nil
+		}
+		return "", nil, err
+	}
+
+	return imageRef[:i], p, nil
+}
+
+func parsePlatform(platform string) (*v1.Platform, error) {
+	p, err := v1.ParsePlatform(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.OS == "" || p.Architecture == "" {
+		return nil, fmt.Errorf("invalid platform %s, expected os/arch[/variant]", platform)
+	}
+
+	return p, nil
+}
+
+// pull the image for platform from imageRef, which may be an index or an image.
+// images for the default platform are pulled if platform is nil. also returns
+// the index the image was selected from, if any
+func pullImage(imageRef string, platform *v1.Platform, opts ...crane.Option) (v1.Image, *indexSource, error) {
+	o := crane.GetOptions(opts...)
+	ref, err := name.ParseReference(imageRef, o.Name...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing reference %q: %w", imageRef, err)
+	}
+
+	desc, err := remote.Get(ref, o.Remote...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// single platform images are used as is unless a platform was requested
+		if platform == nil {
+			return img, nil, nil
+		}
+
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		imgPlatform := v1.Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant, OSVersion: cfg.OSVersion}
+		if imgPlatform.OS == "" {
+			logger.Warnf("%s does not record its platform, assuming it is %s", imageRef, platform)
+		} else if !platformMatches(imgPlatform, platform) {
+			return nil, nil, fmt.Errorf("platform %s not available for %s, it is a single platform image for %s", platform, imageRef, imgPlatform)
+		}
+
+		return img, nil, nil
+	}
+
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return imageForPlatform(idx, desc.Digest, imageRef, platform)
+}
+
+// select the image for platform from the index with digest, or the default
+// platform if nil
+func imageForPlatform(idx v1.ImageIndex, digest v1.Hash, imageRef string, platform *v1.Platform) (v1.Image, *indexSource, error) {
+	if platform == nil {
+		platform = &defaultPlatform
+	}
+
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	available := []string{}
+	for _, m := range manifest.Manifests {
+		if m.Platform == nil || !m.MediaType.IsImage() {
+			continue
+		}
+
+		if platformMatches(*m.Platform, platform) {
+			img, err := idx.Image(m.Digest)
+			return img, &indexSource{digest: digest, platform: *m.Platform}, err
+		}
+		available = append(available, m.Platform.String())
+	}
+
+	return nil, nil, fmt.Errorf("platform %s not available for %s, available platforms: %s", platform, imageRef, strings.Join(available, ", "))
+}
+
+// the variant and os version only need to match if requested
+func platformMatches(p v1.Platform, want *v1.Platform) bool {
+	return p.OS == want.OS &&
+		p.Architecture == want.Architecture &&
+		(want.Variant == "" || p.Variant == want.Variant) &&
+		(want.OSVersion == "" || p.OSVersion == want.OSVersion)
+}
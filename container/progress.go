@@ -0,0 +1,315 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/term"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// how the progress of layer downloads is reported on stderr
+const (
+	// tty if stderr is a terminal, plain otherwise
+	ProgressAuto = "auto"
+	// the status and bytes of every layer, redrawn in place
+	ProgressTTY = "tty"
+	// a line per layer and periodic totals, suitable for logs
+	ProgressPlain = "plain"
+	// one json object per event, for other tools to consume
+	ProgressJSON = "json"
+	// nothing
+	ProgressNone = "none"
+)
+
+// layer statuses shown in the progress display
+const (
+	layerWaiting     = "waiting"
+	layerCached      = "cached"
+	layerDownloading = "downloading"
+	layerDone        = "done"
+	layerFailed      = "failed"
+)
+
+var progress = &progressReporter{mode: ProgressNone, out: os.Stderr}
+
+// SetProgress sets how the progress of layer downloads is reported
+func SetProgress(mode string) error {
+	switch mode {
+	case ProgressAuto:
+		mode = ProgressPlain
+		if term.IsTerminal(int(os.Stderr.Fd())) {
+			mode = ProgressTTY
+		}
+	case ProgressTTY, ProgressPlain, ProgressJSON, ProgressNone:
+	default:
+		return fmt.Errorf("unknown progress mode %s, expected one of auto, tty, plain, json or none", mode)
+	}
+
+	progress = &progressReporter{mode: mode, out: os.Stderr}
+	return nil
+}
+
+type progressReporter struct {
+	mu   sync.Mutex
+	mode string
+	out  io.Writer
+
+	image  string
+	layers []*layerProgress
+	// bytes downloaded for the image, excluding those resumed from earlier fetches
+	downloaded int64
+
+	// when progress was last reported, to limit how often it is
+	reported time.Time
+	// lines drawn by the last tty update
+	lines int
+}
+
+type layerProgress struct {
+	digest v1.Hash
+	size   int64
+	done   int64
+	status string
+}
+
+// a progress event as written with --progress=json
+type progressEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Image   string    `json:"image"`
+	Layer   string    `json:"layer,omitempty"`
+	Current int64     `json:"current,omitempty"`
+	Total   int64     `json:"total,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (p *progressReporter) startImage(imageRef string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.image = imageRef
+	p.layers = nil
+	p.downloaded = 0
+	p.lines = 0
+	p.reported = time.Now()
+
+	p.event(progressEvent{Event: "image-start"})
+}
+
+// add a layer of the image, which is either cached or waiting to be downloaded
+func (p *progressReporter) addLayer(digest v1.Hash, size int64, cached bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	layer := &layerProgress{digest: digest, size: size, status: layerWaiting}
+	if cached {
+		layer.status = layerCached
+		layer.done = size
+	}
+	p.layers = append(p.layers, layer)
+
+	p.event(progressEvent{Event: "layer-" + layer.status, Layer: digest.String(), Total: size})
+	p.draw()
+}
+
+// start downloading a layer, resuming at offset if non zero
+func (p *progressReporter) startLayer(digest v1.Hash, offset int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	layer := p.layer(digest)
+	layer.status = layerDownloading
+	layer.done = offset
+
+	event := "layer-start"
+	if offset > 0 {
+		event = "layer-resume"
+	}
+	p.event(progressEvent{Event: event, Layer: digest.String(), Current: offset, Total: layer.size})
+
+	if p.mode == ProgressPlain {
+		if offset > 0 {
+			p.printf("resuming layer %s at %s of %s", digest, utils.HumanSize(offset), utils.HumanSize(layer.size))
+		} else {
+			p.printf("downloading layer %s (%s)", digest, utils.HumanSize(layer.size))
+		}
+	}
+	p.draw()
+}
+
+func (p *progressReporter) layerBytes(digest v1.Hash, n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	layer := p.layer(digest)
+	layer.done += n
+	p.downloaded += n
+
+	// reporting every chunk copied would flood the output
+	interval := map[string]time.Duration{
+		ProgressTTY:   100 * time.Millisecond,
+		ProgressPlain: 5 * time.Second,
+		ProgressJSON:  time.Second,
+	}[p.mode]
+	if interval == 0 || time.Since(p.reported) < interval {
+		return
+	}
+	p.reported = time.Now()
+
+	switch p.mode {
+	case ProgressJSON:
+		for _, l := range p.layers {
+			if l.status == layerDownloading {
+				p.event(progressEvent{Event: "layer-progress", Layer: l.digest.String(), Current: l.done, Total: l.size})
+			}
+		}
+	case ProgressPlain:
+		done, total, layersDone := p.totals()
+		p.printf("%s of %s, %d of %d layers done", utils.HumanSize(done), utils.HumanSize(total), layersDone, len(p.layers))
+	case ProgressTTY:
+		p.draw()
+	}
+}
+
+// finish downloading a layer, which failed if err is not nil
+func (p *progressReporter) finishLayer(digest v1.Hash, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	layer := p.layer(digest)
+	if err != nil {
+		layer.status = layerFailed
+		p.event(progressEvent{Event: "layer-failed", Layer: digest.String(), Current: layer.done, Total: layer.size, Error: err.Error()})
+	} else {
+		layer.status = layerDone
+		layer.done = layer.size
+		p.event(progressEvent{Event: "layer-done", Layer: digest.String(), Current: layer.size, Total: layer.size})
+	}
+
+	if p.mode == ProgressPlain && err == nil {
+		p.printf("downloaded layer %s", digest)
+	}
+	p.draw()
+}
+
+// finish fetching the image, which failed if err is not nil
+func (p *progressReporter) finishImage(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	done, total, _ := p.totals()
+	event := progressEvent{Event: "image-done", Current: done, Total: total}
+	if err != nil {
+		event.Event = "image-failed"
+		event.Error = err.Error()
+	}
+	p.event(event)
+
+	if p.mode == ProgressPlain && err == nil && p.downloaded > 0 {
+		p.printf("downloaded %s for %d layers", utils.HumanSize(p.downloaded), len(p.layers))
+	}
+	p.draw()
+}
+
+// must be called with the lock held. layers are registered by addLayer, but
+// are added here too so that a missed call can never panic
+func (p *progressReporter) layer(digest v1.Hash) *layerProgress {
+	for _, l := range p.layers {
+		if l.digest == digest {
+			return l
+		}
+	}
+
+	layer := &layerProgress{digest: digest, status: layerWaiting}
+	p.layers = append(p.layers, layer)
+	return layer
+}
+
+func (p *progressReporter) totals() (int64, int64, int) {
+	done, total, layersDone := int64(0), int64(0), 0
+	for _, l := range p.layers {
+		done += l.done
+		total += l.size
+		if l.status == layerCached || l.status == layerDone {
+			layersDone++
+		}
+	}
+
+	return done, total, layersDone
+}
+
+func (p *progressReporter) event(event progressEvent) {
+	if p.mode != ProgressJSON {
+		return
+	}
+
+	event.Time = time.Now()
+	event.Image = p.image
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(p.out, "%s\n", data)
+}
+
+func (p *progressReporter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(p.out, "%s: %s\n", p.image, fmt.Sprintf(format, args...))
+}
+
+// redraw the status of every layer in place of the previous update
+func (p *progressReporter) draw() {
+	if p.mode != ProgressTTY {
+		return
+	}
+	p.reported = time.Now()
+
+	var b strings.Builder
+	if p.lines > 0 {
+		// move to the start of the previous update and clear it
+		fmt.Fprintf(&b, "\x1b[%dA\x1b[J", p.lines)
+	}
+
+	fmt.Fprintf(&b, "%s\n", p.image)
+	for _, l := range p.layers {
+		fmt.Fprintf(&b, "  %s  %-11s", l.digest.Hex[:12], l.status)
+		if l.status == layerDownloading {
+			fmt.Fprintf(&b, "  %s  %s / %s", progressBar(l.done, l.size), utils.HumanSize(l.done), utils.HumanSize(l.size))
+		} else if l.status != layerWaiting {
+			fmt.Fprintf(&b, "  %s", utils.HumanSize(l.size))
+		}
+		b.WriteString("\n")
+	}
+
+	done, total, layersDone := p.totals()
+	fmt.Fprintf(&b, "  %d of %d layers, %s / %s\n", layersDone, len(p.layers), utils.HumanSize(done), utils.HumanSize(total))
+
+	p.lines = len(p.layers) + 2
+	io.WriteString(p.out, b.String())
+}
+
+func progressBar(done, total int64) string {
+	const width = 20
+
+	filled := width
+	if total > 0 && done < total {
+		filled = int(done * width / total)
+	}
+
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "]"
+}
+
+// an io.Writer reporting the bytes written to it as downloaded for a layer
+type layerProgressWriter v1.Hash
+
+func (w layerProgressWriter) Write(b []byte) (int, error) {
+	progress.layerBytes(v1.Hash(w), int64(len(b)))
+	return len(b), nil
+}
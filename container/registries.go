@@ -0,0 +1,323 @@
+package container
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// the registries file configures how each registry is reached, e.g.
+//
+//	{
+//	  "registries": {
+//	    "docker.io": {"mirrors": ["mirror.internal:5000"]},
+//	    "mirror.internal:5000": {"insecure": true},
+//	    "registry.corp": {"ca": "~/.rcon/corp-ca.pem"}
+//	  }
+//	}
+//
+// pulls from a registry with mirrors try each mirror in order before falling
+// back to the registry itself. mirrors use the settings of their own entry
+type registriesConfig struct {
+	Registries map[string]registryConfig `json:"registries"`
+}
+
+type registryConfig struct {
+	// registries, optionally followed by a path prefix, serving the same
+	// repositories as this one
+	Mirrors []string `json:"mirrors,omitempty"`
+	// allow plain http and skip verifying certificates
+	Insecure bool `json:"insecure,omitempty"`
+	// pem file with extra certificate authorities to trust
+	CA string `json:"ca,omitempty"`
+}
+
+var (
+	registriesFile string
+	registries     *registriesConfig
+)
+
+// SetRegistriesFile sets the path of the file configuring registry mirrors
+// and connection settings. a missing file means no configuration
+func SetRegistriesFile(path string) {
+	registriesFile = path
+	registries = nil
+}
+
+func loadRegistries() (*registriesConfig, error) {
+	if registries != nil {
+		return registries, nil
+	}
+
+	cfg := &registriesConfig{}
+	if registriesFile != "" {
+		data, err := os.ReadFile(registriesFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err == nil {
+			if err := json.Unmarshal(data, cfg); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", registriesFile, err)
+			}
+		}
+	}
+
+	// keys are matched against normalized registry names
+	normalized := map[string]registryConfig{}
+	for reg, regCfg := range cfg.Registries {
+		normalized[normalizeRegistry(reg)] = regCfg
+	}
+	cfg.Registries = normalized
+
+	registries = cfg
+	return registries, nil
+}
+
+// registry names are matched without scheme, trailing slash or case, and
+// docker.io is the same as index.docker.io
+func normalizeRegistry(reg string) string {
+	reg = strings.ToLower(reg)
+	reg = strings.TrimPrefix(reg, "https://")
+	reg = strings.TrimPrefix(reg, "http://")
+	reg = strings.TrimSuffix(reg, "/")
+	if reg == "docker.io" {
+		return name.DefaultRegistry
+	}
+	return reg
+}
+
+// the normalized registry of server, which may be a url such as
+// https://index.docker.io/v1/
+func registryHost(server string) string {
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	server, _, _ = strings.Cut(server, "/")
+
+	return normalizeRegistry(server)
+}
+
+// the normalized registry and repository path server applies to, such as
+// ghcr.io/myorg for https://ghcr.io/myorg/. the api paths of urls such as
+// https://index.docker.io/v1/ are dropped
+func normalizeServer(server string) string {
+	server = strings.ToLower(server)
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	server = strings.TrimSuffix(server, "/")
+
+	host, path, _ := strings.Cut(server, "/")
+	if path == "" || path == "v1" || path == "v2" {
+		return normalizeRegistry(host)
+	}
+	return normalizeRegistry(host) + "/" + path
+}
+
+// whether a and b, see normalizeServer, are spellings of the same server
+func sameServer(a, b string) bool {
+	return normalizeServer(a) == normalizeServer(b)
+}
+
+// the first in sort order of the spellings of server in servers
+func findServer(servers []string, server string) (string, bool) {
+	match, found := "", false
+	for _, s := range servers {
+		if sameServer(s, server) && (!found || s < match) {
+			match, found = s, true
+		}
+	}
+	return match, found
+}
+
+// whether server, see matchServer, applies to target
+func matchesServer(server, target string) bool {
+	_, ok := matchServer([]string{server}, target)
+	return ok
+}
+
+// the server in servers which applies to target, a registry or repository
+// such as ghcr.io/myorg/app. servers apply to their registry or repositories
+// under their path, and the longest wins
+func matchServer(servers []string, target string) (string, bool) {
+	target = normalizeServer(target)
+
+	match, matchLen := "", -1
+	for _, server := range servers {
+		prefix := normalizeServer(server)
+		if target != prefix && !strings.HasPrefix(target, prefix+"/") {
+			continue
+		}
+
+		// servers come from maps, so ties between spellings of the same
+		// server go to the first in sort order
+		if len(prefix) > matchLen || (len(prefix) == matchLen && server < match) {
+			match, matchLen = server, len(prefix)
+		}
+	}
+
+	return match, matchLen >= 0
+}
+
+// run fn with imageRef rewritten for each mirror of its registry in turn and
+// finally imageRef itself, until one succeeds. fn is given the crane options
+// for the registry it is called for
+func withMirrors(imageRef, authFile string, fn func(ref string, opts []crane.Option) error) error {
+	cfg, err := loadRegistries()
+	if err != nil {
+		return err
+	}
+
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return fmt.Errorf("parsing reference %q: %w", imageRef, err)
+	}
+
+	refs := []string{}
+	for _, mirror := range cfg.Registries[normalizeRegistry(ref.Context().RegistryStr())].Mirrors {
+		refs = append(refs, mirrorRef(ref, mirror))
+	}
+	refs = append(refs, imageRef)
+
+	errs := []string{}
+	for _, r := range refs {
+		opts, err := craneOptions(cfg, r, authFile)
+		if err == nil {
+			err = fn(r, opts)
+		}
+		if err == nil {
+			return nil
+		}
+
+		// without mirrors the error is returned as is
+		if len(refs) == 1 {
+			return err
+		}
+
+		if r != imageRef {
+			logger.Warnf("Failed to use mirror %s: %v", r, err)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", r, err))
+	}
+
+	return fmt.Errorf("all mirrors failed: %s", strings.Join(errs, "; "))
+}
+
+// the ref for the same repository and tag or digest on a mirror
+func mirrorRef(ref name.Reference, mirror string) string {
+	mirror = strings.TrimSuffix(mirror, "/")
+	mirror = strings.TrimPrefix(mirror, "https://")
+	mirror = strings.TrimPrefix(mirror, "http://")
+
+	repo := mirror + "/" + ref.Context().RepositoryStr()
+	if digest, ok := ref.(name.Digest); ok {
+		return repo + "@" + digest.DigestStr()
+	}
+	return repo + ":" + ref.Identifier()
+}
+
+// options for accessing the registry of imageRef with its configured
+// connection settings and the credentials in authFile falling back to the
+// docker config
+func craneOptions(cfg *registriesConfig, imageRef, authFile string) ([]crane.Option, error) {
+	opts := []crane.Option{crane.WithAuthFromKeychain(keychain(authFile))}
+
+	regCfg, err := lookupRegistry(cfg, imageRef)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := registryTransport(regCfg)
+	if err != nil {
+		return nil, err
+	}
+	if transport != nil {
+		opts = append(opts, crane.WithTransport(transport))
+	}
+
+	if regCfg.Insecure {
+		opts = append(opts, crane.Insecure)
+	}
+
+	return opts, nil
+}
+
+// the settings for the registry of imageRef, empty if it has none
+func lookupRegistry(cfg *registriesConfig, imageRef string) (registryConfig, error) {
+	ref, err := name.ParseReference(imageRef)
+	if err != nil {
+		return registryConfig{}, fmt.Errorf("parsing reference %q: %w", imageRef, err)
+	}
+
+	return cfg.Registries[normalizeRegistry(ref.Context().RegistryStr())], nil
+}
+
+// a transport with the tls settings of a registry, or nil if it has none and
+// the default transport is used
+func registryTransport(regCfg registryConfig) (*http.Transport, error) {
+	if !regCfg.Insecure && regCfg.CA == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: regCfg.Insecure}
+	if regCfg.CA != "" {
+		pool, err := caPool(regCfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := remote.DefaultTransport.Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// an authenticated transport for requests to reg outside of crane, using its
+// configured connection settings
+func authTransport(ctx context.Context, reg name.Registry, regCfg registryConfig, auth authn.Authenticator, scopes []string) (http.RoundTripper, error) {
+	var base http.RoundTripper = remote.DefaultTransport
+	if t, err := registryTransport(regCfg); err != nil {
+		return nil, err
+	} else if t != nil {
+		base = t
+	}
+
+	return transport.NewWithContext(ctx, reg, auth, base, scopes)
+}
+
+// the system certificate authorities plus those in caFile
+func caPool(caFile string) (*x509.CertPool, error) {
+	caFile, err := utils.ExpandPath(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,98 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// each image dir records the containers using it as symlinks to their run dirs
+// under runs/, named after the container id. these keep the image from being
+// reclaimed until the container exits
+const runsDirName = "runs"
+
+// RegisterRun records that the container whose run dir is containerDir is
+// using imageRef
+func RegisterRun(cacheDir, imageRef, containerDir string) error {
+	// the image could otherwise be removed between resolving the ref and
+	// recording the run
+	lock, err := rlockCache(cacheDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	imgDir, err := filepath.EvalSymlinks(getImageDir(cacheDir, imageRef))
+	if err != nil {
+		return err
+	}
+
+	runsDir := filepath.Join(imgDir, runsDirName)
+	err = os.MkdirAll(runsDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	logger.Tracef("Register run %s for %s", filepath.Base(containerDir), imageRef)
+	return os.Symlink(containerDir, filepath.Join(runsDir, filepath.Base(containerDir)))
+}
+
+// ReleaseRun removes the records of container id using images in the cache
+func ReleaseRun(cacheDir, id string) error {
+	markers, err := filepath.Glob(filepath.Join(cacheDir, "*", runsDirName, id))
+	if err != nil {
+		return err
+	}
+
+	for _, marker := range markers {
+		logger.Tracef("Release run %s", marker)
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// returns the ids of containers using an image dir, split into those still
+// running and stale records left behind by containers which did not clean up
+func listRuns(imgDir string) ([]string, []string, error) {
+	markers, err := os.ReadDir(filepath.Join(imgDir, runsDirName))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	active, stale := []string{}, []string{}
+	for _, marker := range markers {
+		containerDir, err := os.Readlink(filepath.Join(imgDir, runsDirName, marker.Name()))
+		if err == nil && runIsActive(containerDir) {
+			active = append(active, marker.Name())
+		} else {
+			stale = append(stale, marker.Name())
+		}
+	}
+
+	return active, stale, nil
+}
+
+// a run is active while its state is recorded and the rcon process which
+// started it holds its lock, see LockRun
+func runIsActive(containerDir string) bool {
+	if !utils.PathExists(filepath.Join(containerDir, stateFileName)) {
+		return false
+	}
+
+	lock, err := utils.TryLockFile(filepath.Join(containerDir, runLockName))
+	if err != nil {
+		return false
+	}
+	if lock == nil {
+		return true
+	}
+
+	_ = lock.Unlock()
+	return false
+}
@@ -0,0 +1,141 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// formats images can be saved in
+const (
+	// a tarball as written by docker save
+	FormatDockerArchive = "docker-archive"
+	// an oci image layout dir
+	FormatOCI = "oci"
+)
+
+// SavedImage is a cached image to write to an archive
+type SavedImage struct {
+	// Ref is the ref the image is cached under
+	Ref string
+	// Name is recorded for the image in the archive if it is a valid image
+	// name, so that it can be loaded under the same name
+	Name string
+}
+
+// SaveImages writes cached images to path as a docker save tarball or an oci
+// image layout. images are added to an existing layout
+func SaveImages(cacheDir, path, format string, images []SavedImage) error {
+	// keep the images from being removed while they are written
+	lock, err := rlockCache(cacheDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	imgs := []v1.Image{}
+	for _, image := range images {
+		imgDir, err := filepath.EvalSymlinks(getImageDir(cacheDir, image.Ref))
+		if err != nil {
+			return fmt.Errorf("image %s not found in cache", image.Ref)
+		}
+
+		img, err := loadCachedImage(cacheDir, imgDir)
+		if err != nil {
+			return err
+		}
+		imgs = append(imgs, img)
+	}
+
+	switch format {
+	case FormatDockerArchive:
+		return saveDockerArchive(path, images, imgs)
+	case FormatOCI:
+		return saveOCILayout(path, images, imgs)
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+}
+
+// the archive is written atomically, so a failed save never leaves a truncated
+// file at path
+func saveDockerArchive(path string, images []SavedImage, imgs []v1.Image) error {
+	refToImage := map[name.Reference]v1.Image{}
+	for i, image := range images {
+		logger.Infof("Saving %s", image.Name)
+
+		ref, err := parseImageName(image.Name)
+		if err != nil {
+			// a docker archive can only hold one image without a name
+			if len(images) > 1 {
+				return fmt.Errorf("%s is not an image name, it can only be saved to a docker archive on its own", image.Name)
+			}
+
+			return utils.WriteAtomic(path, 0644, func(w io.Writer) error {
+				return tarball.Write(nil, imgs[i], w)
+			})
+		}
+
+		refToImage[ref] = imgs[i]
+	}
+
+	return utils.WriteAtomic(path, 0644, func(w io.Writer) error {
+		return tarball.MultiRefWrite(refToImage, w)
+	})
+}
+
+// parse the name an image is saved under. refs to images in local files are
+// not image names, though they would parse as one
+func parseImageName(imageName string) (name.Reference, error) {
+	if isArchiveRef(imageName) {
+		return nil, fmt.Errorf("%s is not an image name", imageName)
+	}
+
+	return name.ParseReference(imageName)
+}
+
+func saveOCILayout(path string, images []SavedImage, imgs []v1.Image) error {
+	p, err := layout.FromPath(path)
+	if err != nil {
+		p, err = layout.Write(path, empty.Index)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, image := range images {
+		digest, err := imgs[i].Digest()
+		if err != nil {
+			return err
+		}
+
+		// tags are recorded the same way as containerd, and replace any image
+		// with the same tag already in the layout
+		annotations := map[string]string{}
+		matcher := match.Digests(digest)
+		if ref, err := parseImageName(image.Name); err == nil {
+			annotations[containerdAnnotation] = image.Name
+			if tag, ok := ref.(name.Tag); ok {
+				annotations[ociRefNameAnnotation] = tag.TagStr()
+				matcher = match.Annotation(ociRefNameAnnotation, tag.TagStr())
+			}
+		}
+
+		logger.Infof("Saving %s", image.Name)
+		err = p.ReplaceImage(imgs[i], matcher, layout.WithAnnotations(annotations))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
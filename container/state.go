@@ -0,0 +1,76 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// State is the metadata recorded in the run dir of each container
+type State struct {
+	ID         string    `json:"id"`
+	Image      string    `json:"image"`
+	Pid        int       `json:"pid"`
+	Created    time.Time `json:"created"`
+	RootFSMode string    `json:"rootfsMode"`
+}
+
+const (
+	stateFileName = "state.json"
+	rootFSDirName = "rootfs"
+	// locked by the rcon process which started the container until it exits
+	runLockName = "lock"
+)
+
+// NewContainerID returns a random id for a container run
+func NewContainerID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// CreateRunDir creates the dir for a container under runDir, named after its
+// id, and records its state there. returns the path of the new dir
+func CreateRunDir(runDir string, state *State) (string, error) {
+	containerDir := filepath.Join(runDir, state.ID)
+	logger.Tracef("Create run dir %s", containerDir)
+
+	// the rootfs dir becomes the container root, so it must be accessible to
+	// users other than container root
+	err := os.MkdirAll(GetRootFSDir(containerDir), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.WriteFile(filepath.Join(containerDir, stateFileName), data, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return containerDir, nil
+}
+
+// LockRun marks the container whose run dir is containerDir as running until
+// the lock is released. pids cannot tell this, as cache garbage collection also
+// runs within the pid namespace of containers
+func LockRun(containerDir string) (*utils.FileLock, error) {
+	return utils.LockFile(filepath.Join(containerDir, runLockName))
+}
+
+// GetRootFSDir returns the rootfs mount point within a container's run dir
+func GetRootFSDir(containerDir string) string {
+	return filepath.Join(containerDir, rootFSDirName)
+}
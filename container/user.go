@@ -0,0 +1,205 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// User is the resolved identity a container process is launched with
+type User struct {
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+	Home   string
+}
+
+type passwdEntry struct {
+	name string
+	uid  uint32
+	gid  uint32
+	home string
+}
+
+type groupEntry struct {
+	name    string
+	gid     uint32
+	members []string
+}
+
+// LookupUser resolves a user spec of the form user[:group] against the passwd and
+// group files found under root. user and group can be either names or numeric ids.
+func LookupUser(root, spec string) (*User, error) {
+	if spec == "" {
+		spec = "0"
+	}
+
+	userPart, groupPart := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userPart, groupPart = spec[:i], spec[i+1:]
+	}
+
+	passwd, err := readPasswd(filepath.Join(root, "/etc/passwd"))
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := readGroup(filepath.Join(root, "/etc/group"))
+	if err != nil {
+		return nil, err
+	}
+
+	u := &User{Home: "/"}
+	userName := ""
+
+	if id, err := parseID(userPart); err == nil {
+		u.Uid = id
+		for _, p := range passwd {
+			if p.uid == id {
+				u.Gid = p.gid
+				u.Home = p.home
+				userName = p.name
+				break
+			}
+		}
+	} else {
+		found := false
+		for _, p := range passwd {
+			if p.name == userPart {
+				u.Uid = p.uid
+				u.Gid = p.gid
+				u.Home = p.home
+				userName = p.name
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("user %s not found in /etc/passwd", userPart)
+		}
+	}
+
+	if groupPart != "" {
+		if id, err := parseID(groupPart); err == nil {
+			u.Gid = id
+		} else {
+			found := false
+			for _, g := range groups {
+				if g.name == groupPart {
+					u.Gid = g.gid
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("group %s not found in /etc/group", groupPart)
+			}
+		}
+	}
+
+	// supplementary groups are only applied when the group is not explicitly set.
+	// root needs none, as it bypasses file permissions, and setting them is not
+	// permitted in some user namespaces
+	if groupPart == "" && userName != "" && u.Uid != 0 {
+		for _, g := range groups {
+			if g.gid == u.Gid {
+				continue
+			}
+			for _, m := range g.members {
+				if m == userName {
+					u.Groups = append(u.Groups, g.gid)
+					break
+				}
+			}
+		}
+	}
+
+	return u, nil
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(id), nil
+}
+
+// readColonFile returns the fields of every non comment line in the file.
+// a missing file is treated as empty since minimal images often lack them
+func readColonFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := [][]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Split(line, ":"))
+	}
+
+	return lines, scanner.Err()
+}
+
+func readPasswd(path string) ([]passwdEntry, error) {
+	lines, err := readColonFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []passwdEntry{}
+	for _, fields := range lines {
+		// name:password:uid:gid:gecos:home:shell
+		if len(fields) < 6 {
+			continue
+		}
+		uid, err := parseID(fields[2])
+		if err != nil {
+			continue
+		}
+		gid, err := parseID(fields[3])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5]})
+	}
+
+	return entries, nil
+}
+
+func readGroup(path string) ([]groupEntry, error) {
+	lines, err := readColonFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []groupEntry{}
+	for _, fields := range lines {
+		// name:password:gid:members
+		if len(fields) < 3 {
+			continue
+		}
+		gid, err := parseID(fields[2])
+		if err != nil {
+			continue
+		}
+		members := []string{}
+		if len(fields) > 3 && fields[3] != "" {
+			members = strings.Split(fields[3], ",")
+		}
+		entries = append(entries, groupEntry{name: fields[0], gid: gid, members: members})
+	}
+
+	return entries, nil
+}
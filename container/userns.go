@@ -0,0 +1,199 @@
+package container
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var errNoSubIDs = errors.New("no subordinate ids configured")
+
+// IDMappings holds the uid and gid mappings for a user namespace
+type IDMappings struct {
+	Uid []syscall.SysProcIDMap
+	Gid []syscall.SysProcIDMap
+}
+
+// LookupSubIDs returns the first subordinate id range assigned to the current
+// user in a subuid/subgid style file (name_or_id:start:count per line)
+func LookupSubIDs(path string) (int, int, error) {
+	u, err := user.Current()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, 0, errNoSubIDs
+	} else if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			continue
+		}
+
+		if fields[0] != u.Username && fields[0] != u.Uid {
+			continue
+		}
+
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil || count <= 0 {
+			continue
+		}
+
+		return start, count, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	return 0, 0, errNoSubIDs
+}
+
+// SubIDMappings builds a mapping where container root is the given host id and
+// ids 1..count map onto the subordinate range listed in path
+func SubIDMappings(path string, hostID int) ([]syscall.SysProcIDMap, error) {
+	start, count, err := LookupSubIDs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: hostID, Size: 1},
+		{ContainerID: 1, HostID: start, Size: count},
+	}, nil
+}
+
+// WriteIDMappings applies uid and gid mappings to the user namespace of pid
+// using the setuid newuidmap/newgidmap helpers
+func WriteIDMappings(pid int, uidMaps, gidMaps []syscall.SysProcIDMap) error {
+	if err := runIDMapHelper("newuidmap", pid, uidMaps); err != nil {
+		return err
+	}
+
+	return runIDMapHelper("newgidmap", pid, gidMaps)
+}
+
+func runIDMapHelper(helper string, pid int, maps []syscall.SysProcIDMap) error {
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range maps {
+		args = append(args, strconv.Itoa(m.ContainerID), strconv.Itoa(m.HostID), strconv.Itoa(m.Size))
+	}
+
+	logger.Tracef("Running %s %v", helper, args)
+	out, err := exec.Command(helper, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w (%s)", helper, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// IDMapHelpersAvailable checks that newuidmap and newgidmap can be found in PATH
+func IDMapHelpersAvailable() bool {
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(helper); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ReadIDMappings parses a /proc/<pid>/uid_map or gid_map file
+func ReadIDMappings(path string) ([]syscall.SysProcIDMap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	maps := []syscall.SysProcIDMap{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+
+		ids := [3]int{}
+		for i, f := range fields {
+			ids[i], err = strconv.Atoi(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid id map %s: %w", path, err)
+			}
+		}
+
+		maps = append(maps, syscall.SysProcIDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]})
+	}
+
+	return maps, nil
+}
+
+// IDMapped reports whether id is mapped in maps, as read by ReadIDMappings
+func IDMapped(maps []syscall.SysProcIDMap, id uint32) bool {
+	for _, m := range maps {
+		if int64(id) >= int64(m.ContainerID) && int64(id) < int64(m.ContainerID)+int64(m.Size) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeepIDMappings builds the mappings for a user namespace nested inside one
+// described by outer, such that the id which container root maps to on the host
+// shows up as that same id again. the rest of the outer range fills in around it
+func KeepIDMappings(outer []syscall.SysProcIDMap) ([]syscall.SysProcIDMap, int, error) {
+	hostID := -1
+	total := 0
+	for _, m := range outer {
+		if m.ContainerID == 0 {
+			hostID = m.HostID
+		}
+		if end := m.ContainerID + m.Size; end > total {
+			total = end
+		}
+	}
+
+	if hostID < 0 {
+		return nil, 0, errors.New("container root is not mapped")
+	}
+
+	// nested id hostID => outer root (0)
+	maps := []syscall.SysProcIDMap{{ContainerID: hostID, HostID: 0, Size: 1}}
+
+	// nested ids 0..hostID-1 => outer 1..hostID
+	below := hostID
+	if below > total-1 {
+		below = total - 1
+	}
+	if below > 0 {
+		maps = append(maps, syscall.SysProcIDMap{ContainerID: 0, HostID: 1, Size: below})
+	}
+
+	// nested ids hostID+1.. => outer hostID+1..
+	if above := total - 1 - hostID; above > 0 {
+		maps = append(maps, syscall.SysProcIDMap{ContainerID: hostID + 1, HostID: hostID + 1, Size: above})
+	}
+
+	return maps, hostID, nil
+}
@@ -0,0 +1,262 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/samirkut/rcon/utils"
+)
+
+// VerifyImage recomputes the digests of the config and layer blobs cached for
+// imageRef and compares them with those recorded in its manifest. with repair
+// set, corrupted files are removed so that the next fetch of the ref downloads
+// them again. the dirs extracted from corrupted layers are removed too, to be
+// extracted again by the next run. they can only be read within the user
+// namespace they were extracted in, so they are not verified themselves. while
+// running containers use them they are marked invalid instead, and removed by
+// verifying again once the containers exit
+func VerifyImage(cacheDir, imageRef string, repair bool, remove Remover) ([]CacheIssue, error) {
+	takeLock := rlockCache
+	if repair {
+		// repairing removes content from the cache
+		takeLock = lockCache
+	}
+	lock, err := takeLock(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	imgDir, err := filepath.EvalSymlinks(getImageDir(cacheDir, imageRef))
+	if err != nil {
+		return nil, fmt.Errorf("image %s not found in cache", imageRef)
+	}
+
+	issues := []CacheIssue{}
+	addIssue := func(path, problem string, fix func() error) error {
+		issue := CacheIssue{Path: path, Problem: problem}
+		if repair {
+			if err := fix(); err != nil {
+				return fmt.Errorf("repair %s: %w", path, err)
+			}
+			issue.Repaired = true
+		}
+		issues = append(issues, issue)
+		return nil
+	}
+
+	// without a readable manifest nothing else can be checked, and the image
+	// is incomplete once it is removed
+	configFile := filepath.Join(imgDir, "config.json")
+	manifestFile := filepath.Join(imgDir, "manifest.json")
+	removeImage := func() error {
+		err := os.Remove(manifestFile)
+		if err == nil || os.IsNotExist(err) {
+			err = os.Remove(configFile)
+		}
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	manifest, err := readManifestFile(manifestFile)
+	if err != nil {
+		problem := fmt.Sprintf("%s: manifest is unreadable: %v", imageRef, err)
+		return issues, addIssue(manifestFile, problem, removeImage)
+	}
+
+	// the image dir is named after the config digest
+	if manifest.Config.Digest.String() != filepath.Base(imgDir) {
+		problem := fmt.Sprintf("%s: manifest is for config %s", imageRef, manifest.Config.Digest)
+		if err := addIssue(manifestFile, problem, removeImage); err != nil {
+			return issues, err
+		}
+	} else if err := verifyBlob(configFile, manifest.Config); err != nil {
+		problem := fmt.Sprintf("%s: config %v", imageRef, err)
+		if err := addIssue(configFile, problem, removeImage); err != nil {
+			return issues, err
+		}
+	}
+
+	var inUse map[string]bool
+	layerInUse := func(digest v1.Hash) (bool, error) {
+		if inUse == nil {
+			layers, err := layersInUse(cacheDir)
+			if err != nil {
+				return false, err
+			}
+			inUse = layers
+		}
+		return inUse[digest.String()], nil
+	}
+
+	for _, desc := range manifest.Layers {
+		digest := desc.Digest
+		blobFile := getLayerBlob(cacheDir, digest)
+		if err := verifyBlob(blobFile, desc); err != nil {
+			problem := fmt.Sprintf("%s: layer %s %v", imageRef, digest, err)
+			removeLayer := func() error {
+				used, err := layerInUse(digest)
+				if err != nil {
+					return err
+				}
+				return removeLayerContent(cacheDir, digest, !used, remove)
+			}
+			if err := addIssue(blobFile, problem, removeLayer); err != nil {
+				return issues, err
+			}
+		}
+
+		// the blob was repaired while the dir extracted from it was in use
+		invalidFile := filepath.Join(getLayerDir(cacheDir, digest), layerInvalidName)
+		if !utils.PathExists(invalidFile) {
+			continue
+		}
+
+		diffDir := filepath.Join(getLayerDir(cacheDir, digest), layerDiffName)
+		problem := fmt.Sprintf("%s: layer %s was extracted from a corrupted blob", imageRef, digest)
+		used := false
+		if repair {
+			used, err = layerInUse(digest)
+			if err != nil {
+				return issues, err
+			}
+		}
+		if used {
+			// reported as found, as it cannot be repaired yet
+			issues = append(issues, CacheIssue{Path: diffDir, Problem: problem + ", verify again once its containers exit"})
+			continue
+		}
+		if err := addIssue(diffDir, problem, func() error { return removeLayerContent(cacheDir, digest, true, remove) }); err != nil {
+			return issues, err
+		}
+	}
+
+	return issues, nil
+}
+
+func readManifestFile(manifestFile string) (*v1.Manifest, error) {
+	f, err := os.Open(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest := &v1.Manifest{}
+	err = json.NewDecoder(f).Decode(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// compare the size and digest of a file against its descriptor
+func verifyBlob(path string, desc v1.Descriptor) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return errors.New("is missing")
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	digest, size, err := v1.SHA256(f)
+	if err != nil {
+		return err
+	}
+
+	if size != desc.Size {
+		return fmt.Errorf("is corrupted, size is %d instead of %d", size, desc.Size)
+	}
+
+	if digest != desc.Digest {
+		return fmt.Errorf("is corrupted, digest is %s", digest)
+	}
+
+	return nil
+}
+
+// remove the blob of a layer along with the dir extracted from it if
+// removeDiff is set, as that may have been extracted from the corrupted blob.
+// otherwise the dir is marked invalid so that runs no longer use it
+func removeLayerContent(cacheDir string, digest v1.Hash, removeDiff bool, remove Remover) error {
+	lock, err := lockLayer(cacheDir, digest)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	layerDir := getLayerDir(cacheDir, digest)
+	err = os.Remove(filepath.Join(layerDir, layerBlobName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	diffDir := filepath.Join(layerDir, layerDiffName)
+	invalidFile := filepath.Join(layerDir, layerInvalidName)
+	if utils.PathExists(diffDir) {
+		if !removeDiff {
+			logger.Warnf("Keeping %s until its containers exit, it may have been extracted from the corrupted blob", diffDir)
+			return utils.WriteFileAtomic(invalidFile, nil, 0644)
+		}
+
+		if err := remove(diffDir); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(invalidFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// the layers of images with running containers, which overlay rootfs mounts
+// use as lower dirs. if an image cannot be read, all layers count as in use
+func layersInUse(cacheDir string) (map[string]bool, error) {
+	entries, err := listImageDirs(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := map[string]bool{}
+	for _, entry := range entries {
+		if len(entry.runs) == 0 {
+			continue
+		}
+
+		manifest, err := readCachedManifest(cacheDir, entry.dir)
+		if err != nil {
+			logger.Warnf("Cannot read image %s, keeping all extracted layers: %v", filepath.Base(entry.dir), err)
+			return allLayers(cacheDir)
+		}
+
+		for _, desc := range manifest.Layers {
+			inUse[desc.Digest.String()] = true
+		}
+	}
+
+	return inUse, nil
+}
+
+func allLayers(cacheDir string) (map[string]bool, error) {
+	layers, err := os.ReadDir(filepath.Join(cacheDir, layersDirName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	all := map[string]bool{}
+	for _, layer := range layers {
+		all[layer.Name()] = true
+	}
+
+	return all, nil
+}
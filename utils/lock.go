@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// FileLock is an advisory lock on a file, shared between processes with flock
+type FileLock struct {
+	f *os.File
+}
+
+// LockFile takes an exclusive lock on path, creating it if needed. blocks
+// until the lock is available
+func LockFile(path string) (*FileLock, error) {
+	return lockFile(path, syscall.LOCK_EX)
+}
+
+// RLockFile takes a shared lock on path, creating it if needed. blocks while
+// an exclusive lock is held
+func RLockFile(path string) (*FileLock, error) {
+	return lockFile(path, syscall.LOCK_SH)
+}
+
+// TryLockFile takes an exclusive lock on path without blocking. returns nil
+// if another process holds a lock on it
+func TryLockFile(path string) (*FileLock, error) {
+	lock, err := lockFile(path, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return nil, nil
+	}
+
+	return lock, err
+}
+
+func lockFile(path string, how int) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err = syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &FileLock{f: f}, nil
+}
+
+// Unlock releases the lock. it is safe to call more than once
+func (l *FileLock) Unlock() error {
+	if l.f == nil {
+		return nil
+	}
+
+	// closing the file releases the lock
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
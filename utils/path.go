@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -52,3 +56,106 @@ func EnsureDir(path string) (string, error) {
 
 	return path, nil
 }
+
+// RemoveAll is os.RemoveAll but also handles directories without write
+// permission, as extracted images commonly contain them
+func RemoveAll(path string) error {
+	err := os.RemoveAll(path)
+	if err == nil {
+		return nil
+	}
+
+	_ = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			_ = os.Chmod(p, 0700)
+		}
+		return nil
+	})
+
+	return os.RemoveAll(path)
+}
+
+// WriteFileAtomic is os.WriteFile but writes to a temp file which is renamed
+// into place, so that path is either missing or complete
+func WriteFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	return WriteAtomic(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteAtomic is WriteFileAtomic with the contents written by write, which
+// leaves nothing at path if it fails
+func WriteAtomic(path string, perm fs.FileMode, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// ReplaceSymlink points link at target, replacing any existing link without
+// a window where link is missing
+func ReplaceSymlink(target, link string) error {
+	// pids are no use for unique names, as they repeat across pid namespaces
+	for {
+		suffix := make([]byte, 8)
+		if _, err := rand.Read(suffix); err != nil {
+			return err
+		}
+
+		tmp := fmt.Sprintf("%s.tmp-%x", link, suffix)
+		err := os.Symlink(target, tmp)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(tmp, link)
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+
+		return nil
+	}
+}
+
+// HumanSize formats a size in bytes using decimal units, e.g. 12.3MB
+func HumanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[unit])
+	}
+
+	return fmt.Sprintf("%.3g%s", value, units[unit])
+}
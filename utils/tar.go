@@ -7,11 +7,65 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+type untarMode int
+
+const (
+	// plain tar extraction
+	untarPlain untarMode = iota
+	// apply whiteouts against the contents of target
+	untarApply
+	// convert whiteouts to the overlayfs representation
+	untarOverlay
+)
+
+const (
+	// OCI whiteout markers. a file named .wh.<name> deletes <name> from lower
+	// layers, and .wh..wh..opq hides all lower layer contents of its directory
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
 )
 
 func Untar(tarball, target string) error {
 	logger.Tracef("Untar %s into %s", tarball, target)
 
+	reader, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return untar(reader, target, untarPlain)
+}
+
+// ApplyLayer extracts an uncompressed layer tar stream on top of target,
+// processing whiteouts against the contents left by previous layers
+func ApplyLayer(layer io.Reader, target string) error {
+	logger.Tracef("Apply layer into %s", target)
+
+	return untar(layer, target, untarApply)
+}
+
+// ExtractOverlayLayer extracts an uncompressed layer tar stream into an empty
+// target for use as an overlayfs lower dir. whiteouts become 0/0 character
+// devices and opaque dirs are marked with the user.overlay.opaque xattr, which
+// requires the overlay to be mounted with the userxattr option
+func ExtractOverlayLayer(layer io.Reader, target string) error {
+	logger.Tracef("Extract overlay layer into %s", target)
+
+	return untar(layer, target, untarOverlay)
+}
+
+func untar(reader io.Reader, target string, mode untarMode) error {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+
 	currDir, err := os.Getwd()
 	if err != nil {
 		return err
@@ -26,15 +80,13 @@ func Untar(tarball, target string) error {
 		_ = os.Chdir(currDir)
 	}()
 
-	reader, err := os.Open(tarball)
-	if err != nil {
-		return err
-	}
-	defer reader.Close()
 	tarReader := tar.NewReader(reader)
 
 	delayedPerms := make(map[string]fs.FileMode)
 
+	// paths written by this layer. opaque whiteouts only hide lower layers
+	added := make(map[string]bool)
+
 	for {
 		header, err := tarReader.Next()
 		// if no more files are found return
@@ -50,8 +102,76 @@ func Untar(tarball, target string) error {
 			continue
 		}
 
-		path := filepath.Join(target, header.Name)
+		if !isWithin(target, filepath.Join(target, header.Name)) {
+			return fmt.Errorf("tar entry %s escapes %s", header.Name, target)
+		}
+
+		// symlinks extracted earlier must not lead entries out of target
+		path, err := resolveInRoot(target, header.Name)
+		if err != nil {
+			return fmt.Errorf("tar entry %s: %w", header.Name, err)
+		}
+
 		info := header.FileInfo()
+
+		if mode != untarPlain {
+			base := filepath.Base(path)
+			dir := filepath.Dir(path)
+
+			if base == whiteoutOpaque {
+				logger.Tracef("Opaque whiteout %s", dir)
+				if err = os.MkdirAll(dir, 0755); err != nil {
+					return err
+				}
+				if mode == untarOverlay {
+					err = unix.Setxattr(dir, "user.overlay.opaque", []byte("y"), 0)
+				} else {
+					err = removeOpaque(dir, added)
+				}
+				if err != nil {
+					return fmt.Errorf("cannot make %s opaque: %w", dir, err)
+				}
+				continue
+			}
+
+			if strings.HasPrefix(base, whiteoutPrefix) {
+				name := strings.TrimPrefix(base, whiteoutPrefix)
+				if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+					return fmt.Errorf("tar entry %s is not a valid whiteout", header.Name)
+				}
+
+				hidden := filepath.Join(dir, name)
+				if hidden == target || !isWithin(target, hidden) {
+					return fmt.Errorf("tar entry %s escapes %s", header.Name, target)
+				}
+				logger.Tracef("Whiteout %s", hidden)
+				if err = os.RemoveAll(hidden); err != nil {
+					return err
+				}
+				if mode == untarOverlay {
+					if err = os.MkdirAll(dir, 0755); err != nil {
+						return err
+					}
+					if err = unix.Mknod(hidden, unix.S_IFCHR, 0); err != nil {
+						return fmt.Errorf("cannot create whiteout %s: %w", hidden, err)
+					}
+				}
+				continue
+			}
+
+			added[path] = true
+		}
+
+		// replace whatever is at this path, unless both are dirs. writing to an
+		// existing symlink would follow it
+		if fi, err := os.Lstat(path); err == nil && path != target {
+			if !fi.IsDir() || header.Typeflag != tar.TypeDir {
+				if err = os.RemoveAll(path); err != nil {
+					return err
+				}
+			}
+		}
+
 		logger.Tracef("Extracting %s (%s)", path, info.Mode().String())
 
 		switch header.Typeflag {
@@ -65,6 +185,10 @@ func Untar(tarball, target string) error {
 			if err = os.MkdirAll(path, dirMode); err != nil {
 				return err
 			}
+			lchown(path, header)
+			if err = os.Chmod(path, dirMode); err != nil {
+				return err
+			}
 		case tar.TypeReg:
 			file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
 			if err != nil {
@@ -76,16 +200,23 @@ func Untar(tarball, target string) error {
 				return err
 			}
 			_ = file.Close()
+			// chown clears setuid/setgid bits so the mode is applied after it
+			lchown(path, header)
+			if err = os.Chmod(path, info.Mode()); err != nil {
+				return err
+			}
 		case tar.TypeSymlink:
 			linkTarget := header.Linkname
-			path = header.Name
 			err = os.Symlink(linkTarget, path)
 			if err != nil {
 				return fmt.Errorf("cannot make symlink from %s to %s: %w", path, linkTarget, err)
 			}
+			lchown(path, header)
 		case tar.TypeLink:
-			linkTarget := header.Linkname
-			path = header.Name
+			linkTarget, err := resolveInRoot(target, header.Linkname)
+			if err != nil {
+				return fmt.Errorf("tar entry %s: %w", header.Name, err)
+			}
 			err = os.Link(linkTarget, path)
 			if err != nil {
 				return fmt.Errorf("cannot make link from %s to %s: %w", path, linkTarget, err)
@@ -103,3 +234,93 @@ func Untar(tarball, target string) error {
 
 	return nil
 }
+
+// remove everything under dir that was not added by the current layer
+func removeOpaque(dir string, keep map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if !keep[path] {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if e.IsDir() {
+			if err := removeOpaque(path, keep); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// whether path is dir or lies under it, without resolving symlinks
+func isWithin(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// the path of name within root, with symlinks in its parent dirs resolved as
+// if root were the filesystem root, so that it never lies outside root. the
+// last element is not resolved
+func resolveInRoot(root, name string) (string, error) {
+	// the number of symlinks followed before giving up, as the kernel does
+	const maxLinks = 40
+
+	dir, base := filepath.Split(filepath.Clean("/" + name))
+	parts := strings.Split(dir, "/")
+	resolved := "/"
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxLinks {
+			return "", fmt.Errorf("too many levels of symlinks in %s", name)
+		}
+
+		linkTarget, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(linkTarget) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(linkTarget, "/"), parts...)
+	}
+
+	return filepath.Join(root, resolved, base), nil
+}
+
+// ownership can only be applied for ids mapped in the current user namespace.
+// failures are ignored so images still extract with a single id mapping
+func lchown(path string, header *tar.Header) {
+	if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+		logger.Tracef("Cannot chown %s to %d:%d: %v", path, header.Uid, header.Gid, err)
+	}
+}
@@ -0,0 +1,273 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type tarEntry struct {
+	name string
+	// file contents, the target of symlinks and hard links
+	body string
+	typ  byte
+}
+
+func file(name, body string) tarEntry { return tarEntry{name: name, body: body, typ: tar.TypeReg} }
+func dir(name string) tarEntry        { return tarEntry{name: name, typ: tar.TypeDir} }
+func symlink(name, target string) tarEntry {
+	return tarEntry{name: name, body: target, typ: tar.TypeSymlink}
+}
+func hardlink(name, target string) tarEntry {
+	return tarEntry{name: name, body: target, typ: tar.TypeLink}
+}
+
+func makeTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Typeflag: e.typ, Mode: 0644}
+		switch e.typ {
+		case tar.TypeReg:
+			h.Size = int64(len(e.body))
+		case tar.TypeDir:
+			h.Mode = 0755
+		case tar.TypeSymlink, tar.TypeLink:
+			h.Linkname = e.body
+		}
+
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if e.typ == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf
+}
+
+// a target dir inside a parent holding a sentinel file, which extraction must
+// never touch
+func setupTarget(t *testing.T) (string, string) {
+	t.Helper()
+
+	parent := t.TempDir()
+	target := filepath.Join(parent, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sentinel := filepath.Join(parent, "sentinel")
+	if err := os.WriteFile(sentinel, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return target, sentinel
+}
+
+// the paths under dir, with dirs marked by a trailing slash
+func listTree(t *testing.T, dir string) []string {
+	t.Helper()
+
+	paths := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		if info.IsDir() {
+			rel += "/"
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+func assertTree(t *testing.T, dir string, want ...string) {
+	t.Helper()
+
+	got := listTree(t, dir)
+	sort.Strings(want)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got tree %v, want %v", got, want)
+	}
+}
+
+func TestApplyLayerWhiteout(t *testing.T) {
+	target, _ := setupTarget(t)
+
+	lower := makeTar(t, dir("etc/"), file("etc/a", "a"), file("etc/b", "b"), dir("var/"), file("var/c", "c"))
+	if err := ApplyLayer(lower, target); err != nil {
+		t.Fatal(err)
+	}
+
+	upper := makeTar(t, file("etc/.wh.a", ""), file(".wh.var", ""))
+	if err := ApplyLayer(upper, target); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTree(t, target, "etc/", "etc/b")
+}
+
+func TestApplyLayerOpaque(t *testing.T) {
+	target, _ := setupTarget(t)
+
+	lower := makeTar(t, dir("etc/"), file("etc/a", "a"), dir("etc/sub/"), file("etc/sub/b", "b"))
+	if err := ApplyLayer(lower, target); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries of the same layer survive the opaque marker wherever it appears
+	upper := makeTar(t, dir("etc/"), file("etc/new", "n"), file("etc/.wh..wh..opq", ""), file("etc/later", "l"))
+	if err := ApplyLayer(upper, target); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTree(t, target, "etc/", "etc/later", "etc/new")
+}
+
+func TestApplyLayerInvalidWhiteouts(t *testing.T) {
+	for _, name := range []string{".wh...", ".wh..", "sub/.wh...", ".wh."} {
+		t.Run(name, func(t *testing.T) {
+			target, sentinel := setupTarget(t)
+
+			layer := makeTar(t, dir("sub/"), file("sub/a", "a"), file(name, ""))
+			if err := ApplyLayer(layer, target); err == nil {
+				t.Errorf("whiteout %s was accepted", name)
+			}
+
+			if _, err := os.Stat(sentinel); err != nil {
+				t.Errorf("sentinel next to target was removed: %v", err)
+			}
+			assertTree(t, target, "sub/", "sub/a")
+		})
+	}
+}
+
+func TestApplyLayerEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"dotdot", []tarEntry{file("../escaped", "x")}},
+		{"nested dotdot", []tarEntry{dir("sub/"), file("sub/../../escaped", "x")}},
+		{"hard link out", []tarEntry{hardlink("link", "../sentinel")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, sentinel := setupTarget(t)
+
+			_ = ApplyLayer(makeTar(t, tt.entries...), target)
+
+			if _, err := os.Stat(filepath.Join(filepath.Dir(target), "escaped")); err == nil {
+				t.Error("entry was written outside target")
+			}
+			if data, err := os.ReadFile(sentinel); err != nil || string(data) != "keep" {
+				t.Errorf("sentinel next to target was changed: %q, %v", data, err)
+			}
+
+			// a hard link to the sentinel would share its inode
+			fi, err := os.Stat(sentinel)
+			if link, linkErr := os.Stat(filepath.Join(target, "link")); err == nil && linkErr == nil && os.SameFile(fi, link) {
+				t.Error("hard link points outside target")
+			}
+		})
+	}
+}
+
+func TestApplyLayerSymlinkEscapes(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+	}{
+		{"absolute", "/"},
+		{"relative", "../.."},
+		{"absolute to parent", "/../.."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, sentinel := setupTarget(t)
+			parent := filepath.Dir(target)
+
+			// the link points at the parent of target when followed on the host
+			link := tt.link
+			if link == "/" {
+				link = parent
+			}
+
+			layer := makeTar(t,
+				symlink("a", link),
+				dir("a/sub/"),
+				file("a/escaped", "x"),
+				file("a/.wh.sentinel", ""),
+			)
+			// parents which do not exist within target may fail to extract,
+			// but must never resolve outside of it
+			_ = ApplyLayer(layer, target)
+
+			if _, err := os.Stat(filepath.Join(parent, "escaped")); err == nil {
+				t.Error("entry was written through a symlink outside target")
+			}
+			if _, err := os.Stat(sentinel); err != nil {
+				t.Errorf("whiteout through a symlink removed the sentinel: %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyLayerSymlinkWithinTarget(t *testing.T) {
+	target, _ := setupTarget(t)
+
+	// merged /usr layouts write through symlinks, which resolve within target
+	layer := makeTar(t,
+		dir("usr/"), dir("usr/lib/"),
+		symlink("lib", "usr/lib"),
+		file("lib/a", "a"),
+		symlink("abs", "/usr/lib"),
+		file("abs/b", "b"),
+	)
+	if err := ApplyLayer(layer, target); err != nil {
+		t.Fatal(err)
+	}
+
+	assertTree(t, target, "abs", "lib", "usr/", "usr/lib/", "usr/lib/a", "usr/lib/b")
+}
+
+func TestApplyLayerReplacesSymlink(t *testing.T) {
+	target, sentinel := setupTarget(t)
+
+	// a file entry over an existing symlink replaces the link rather than
+	// writing to what it points at
+	layer := makeTar(t, symlink("f", sentinel), file("f", "new"))
+	if err := ApplyLayer(layer, target); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(sentinel); string(data) != "keep" {
+		t.Errorf("sentinel was overwritten with %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(target, "f")); string(data) != "new" {
+		t.Errorf("f is %q, want new", data)
+	}
+}